@@ -0,0 +1,204 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Agitate back and forth across the middle of the travel until stop is closed, the deadline has passed or strokeLimit
+// strokes have been counted for the phase. A stroke is one pass from one end of the travel to the other, followed by
+// the dwell. Stops are only taken at the end of a stroke, unless the context is cancelled. A zero deadline or stroke
+// limit is no limit. Returns true if a limit ended the agitation. The machine must be in the Agitating state.
+func (pg *PlateGenie) agitate(ctx context.Context, stop <-chan struct{}, deadline time.Time, strokeLimit int,
+	settings func() Settings) (bool, error) {
+
+	limited := false
+	stopped := func() bool {
+		select {
+		case <-stop:
+			return true
+		default:
+		}
+		if passed(deadline) || (strokeLimit > 0 && pg.phaseStrokes() >= strokeLimit) {
+			limited = true
+			return true
+		}
+		return false
+	}
+
+	// Count the stroke just finished and let the liquid settle before the next one. Returns true if the agitation
+	// should end.
+	endStroke := func(s Settings) (bool, error) {
+		pg.countStroke()
+		if stopped() {
+			return true, nil
+		}
+		if s.DwellMilliseconds == 0 {
+			return false, nil
+		}
+		until := time.Now().Add(time.Duration(s.DwellMilliseconds) * time.Millisecond)
+		if !deadline.IsZero() && deadline.Before(until) {
+			until = deadline
+		}
+		if interrupted, err := pg.pause(ctx, stop, until); err != nil || interrupted {
+			return true, err
+		}
+		return stopped(), nil
+	}
+
+	// Left and right ends of a stroke of the given travel, centred on the travel
+	strokeEnds := func(s Settings) (int, int, error) {
+		distance, err := pg.strokeSteps(s)
+		left := (pg.TravelSteps() - distance) / 2
+		return left, left + distance, err
+	}
+
+	// Move to the left end of the first stroke
+	s := settings()
+	left, _, err := strokeEnds(s)
+	if err != nil {
+		return false, err
+	}
+	if err := pg.moveProfile(ctx, left-pg.Position(), s); err != nil {
+		return false, err
+	}
+
+	// The settings are read again for every stroke, which picks up changes made while agitating and lets a pattern
+	// vary the strokes
+	for toRight := true; ; toRight = !toRight {
+		s = settings()
+		left, right, err := strokeEnds(s)
+		if err != nil {
+			return false, err
+		}
+		target := left
+		if toRight {
+			target = right
+		}
+		if err := pg.moveProfile(ctx, target-pg.Position(), s); err != nil {
+			return false, err
+		}
+		if done, err := endStroke(s); err != nil || done {
+			return limited, err
+		}
+	}
+}
+
+// Whether a deadline has been set and has passed
+func passed(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// Park the carriage in the centre at the end of a cycle that ended on a limit
+func (pg *PlateGenie) returnToCentre(ctx context.Context) error {
+	fmt.Println("Agitation limit reached, returning to the centre")
+	return pg.moveWithSettings(ctx, pg.TravelSteps()/2-pg.Position(), pg.Settings())
+}
+
+// Agitate for p.AgitateSeconds at the start of every p.IntervalSeconds until the deadline or the phase's stroke limit,
+// parked in the centre in between. Returns true if a limit ended the phase.
+func (pg *PlateGenie) agitateIntervals(ctx context.Context, stop <-chan struct{}, deadline time.Time,
+	p Phase) (bool, error) {
+
+	s := p.settings()
+	settings := func() Settings { return s }
+	strokesDone := func() bool {
+		return p.Strokes > 0 && pg.phaseStrokes() >= p.Strokes
+	}
+
+	for start := time.Now(); ; start = start.Add(time.Duration(p.IntervalSeconds) * time.Second) {
+		burstEnd := start.Add(time.Duration(p.AgitateSeconds) * time.Second)
+		if !deadline.IsZero() && burstEnd.After(deadline) {
+			burstEnd = deadline
+		}
+		limited, err := pg.agitate(ctx, stop, burstEnd, p.Strokes, settings)
+		if err != nil || !limited {
+			return false, err
+		}
+		if passed(deadline) || strokesDone() {
+			return true, nil
+		}
+
+		// Rest until the next interval, or the end of the phase for a single burst
+		restEnd := deadline
+		next := start.Add(time.Duration(p.IntervalSeconds) * time.Second)
+		if p.IntervalSeconds > 0 && (deadline.IsZero() || next.Before(deadline)) {
+			restEnd = next
+		}
+		if err := pg.moveWithSettings(ctx, pg.TravelSteps()/2-pg.Position(), s); err != nil {
+			return false, err
+		}
+		stopped, err := pg.rest(ctx, stop, restEnd, p.ReleaseCoils)
+		if err != nil || stopped {
+			return false, err
+		}
+		if passed(deadline) {
+			return true, nil
+		}
+	}
+}
+
+// Wait with the carriage parked until the given time. Returns true if stop was closed first. An emergency stop or a
+// fault ends the rest with an error, the same as it would end a move.
+func (pg *PlateGenie) rest(ctx context.Context, stop <-chan struct{}, until time.Time, releaseCoils bool) (bool,
+	error) {
+
+	fmt.Println("Resting until", until.Format("15:04:05"))
+	pg.setResting(true)
+	defer pg.setResting(false)
+
+	if releaseCoils {
+		pg.setCoils(false)
+		defer pg.restoreCoilHold()
+	}
+
+	return pg.pause(ctx, stop, until)
+}
+
+// Wait in place until the given time. Returns true if stop was closed first. An emergency stop or a fault ends the
+// wait with an error.
+func (pg *PlateGenie) pause(ctx context.Context, stop <-chan struct{}, until time.Time) (bool, error) {
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	ticker := time.NewTicker(holdPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return false, nil
+		case <-stop:
+			return true, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-ticker.C:
+			if err := pg.state.checkMotion(); err != nil {
+				return false, err
+			}
+		}
+	}
+}
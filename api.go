@@ -0,0 +1,317 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// The calls below block until the motion is finished, except for StartAgitation. They return a *StateError if the
+// machine is not in a state that permits the command, or if the motion was stopped by an emergency stop or a fault.
+//
+// Cancelling the context slows a move down to rest the way a feed hold does, or stops homing after the current step,
+// and returns the context's error. This is not an emergency stop: the position stays accurate and the machine goes
+// back to Idle, or to Unhomed if homing was interrupted.
+
+// Find both limit switches, measure the travel between them and park the carriage in the centre
+func (pg *PlateGenie) Home(ctx context.Context) error {
+	return pg.homeBoth(ctx)
+}
+
+// Move to an absolute position in steps. 0 is next to the left switch and TravelSteps() is next to the right switch.
+func (pg *PlateGenie) MoveTo(ctx context.Context, position int) error {
+	return pg.moveTo(ctx, "Move to "+strconv.Itoa(position), func(int) int {
+		return position
+	})
+}
+
+// Move relative to the current position. Positive steps move to the right.
+func (pg *PlateGenie) MoveBy(ctx context.Context, steps int) error {
+	return pg.moveTo(ctx, "Move by "+strconv.Itoa(steps), func(current int) int {
+		return current + steps
+	})
+}
+
+// Plan a move of steps with the profile, speed and acceleration in the settings without turning the motor. Positive
+// steps move to the right. The timeline can be checked against the stepper with Check, or graphed.
+func (pg *PlateGenie) PlanMove(steps int, s Settings) (Timeline, error) {
+	return pg.planMove(steps, s)
+}
+
+func (pg *PlateGenie) moveTo(ctx context.Context, reason string, target func(current int) int) error {
+	if err := pg.state.transition(StateMoving, reason); err != nil {
+		return err
+	}
+
+	current := pg.Position()
+	travel := pg.TravelSteps()
+	position := target(current)
+	if position < 0 || position > travel {
+		pg.state.transitionFrom(StateMoving, StateIdle, "Move rejected")
+		return &RangeError{"Position", position, 0, travel}
+	}
+
+	err := pg.moveWithSettings(ctx, position-current, pg.Settings())
+	pg.finishMotion(StateMoving, err)
+
+	return err
+}
+
+// Run the segments of a motion program one after the other with the speed and acceleration in the settings. The
+// carriage only stops where the program reverses or dwells. This is the only way to run a program: the menu and the
+// recipe patterns do not queue segments. See queue.go.
+func (pg *PlateGenie) RunProgram(ctx context.Context, segments []Segment) error {
+	reason := "Motion program of " + strconv.Itoa(len(segments)) + " segments"
+	if err := pg.state.transition(StateMoving, reason); err != nil {
+		return err
+	}
+
+	// Every segment has to end inside the travel
+	position := pg.Position()
+	travel := pg.TravelSteps()
+	for _, seg := range segments {
+		position += seg.Steps
+		if position < 0 || position > travel {
+			pg.state.transitionFrom(StateMoving, StateIdle, "Motion program rejected")
+			return &RangeError{"Position", position, 0, travel}
+		}
+	}
+
+	q, err := pg.queueProgram(segments, pg.Settings())
+	if err != nil {
+		pg.state.transitionFrom(StateMoving, StateIdle, "Motion program rejected")
+		return err
+	}
+
+	err = pg.playQueue(ctx, q)
+	pg.finishMotion(StateMoving, err)
+
+	return err
+}
+
+// Start agitating with the current settings. Returns once the cycle has started. The cycle runs for
+// Settings().AgitationSeconds or Settings().AgitationStrokes, whichever comes first, and then returns the carriage to
+// the centre. If both are 0 the cycle runs until StopAgitation is called. Either way it can be ended early with
+// StopAgitation or by cancelling the context.
+func (pg *PlateGenie) StartAgitation(ctx context.Context) error {
+	s := pg.Settings()
+	var deadline time.Time
+	if s.AgitationSeconds > 0 {
+		deadline = time.Now().Add(time.Duration(s.AgitationSeconds) * time.Second)
+	}
+	status := AgitationStatus{StrokeLimit: s.AgitationStrokes}
+
+	run := func(stop <-chan struct{}) (bool, error) {
+		limited, err := pg.agitate(ctx, stop, deadline, s.AgitationStrokes, pg.Settings)
+		if err != nil || !limited {
+			return false, err
+		}
+		return true, pg.returnToCentre(ctx)
+	}
+	return pg.startCycle(ctx, "Agitation cycle", RunRecord{}, status, deadline, run)
+}
+
+// Enter the Agitating state and run a cycle in the background until it returns. The status and the deadline are the
+// ones reported by AgitationStatus() until the cycle changes them. run returns true if the cycle ran to its end
+// rather than being stopped. The cycle is added to the run history, starting from the recipe name and the seed in
+// record.
+func (pg *PlateGenie) startCycle(ctx context.Context, reason string, record RunRecord, status AgitationStatus,
+	deadline time.Time, run func(stop <-chan struct{}) (bool, error)) error {
+
+	if err := pg.state.transition(StateAgitating, reason); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	pg.mu.Lock()
+	pg.agitationStop = stop
+	pg.agitationDone = done
+	pg.agitationStatus = status
+	pg.agitationDeadline = deadline
+	pg.mu.Unlock()
+
+	record.Start = time.Now()
+
+	// Not tracked by Run(), which only waits for the motion that it started itself. Close() waits for the cycle.
+	go func() {
+		complete, err := run(stop)
+		pg.finishMotion(StateAgitating, err)
+
+		pg.mu.Lock()
+		record.Strokes = pg.agitationStatus.TotalStrokes
+		if pg.agitationDone == done {
+			pg.agitationStop = nil
+			pg.agitationDone = nil
+			pg.agitationStatus = AgitationStatus{}
+			pg.agitationDeadline = time.Time{}
+		}
+		pg.mu.Unlock()
+
+		record.End = time.Now()
+		switch {
+		case err != nil:
+			record.Result = err.Error()
+		case complete:
+			record.Result = RunComplete
+		default:
+			record.Result = RunStopped
+		}
+		pg.addRunRecord(record)
+
+		close(done)
+	}()
+
+	return nil
+}
+
+// Stop agitating at the end of the current stroke. Blocks until the carriage has stopped or the context is cancelled.
+// The stroke is finished either way, unless it is held by a feed hold, in which case the stroke is aborted.
+func (pg *PlateGenie) StopAgitation(ctx context.Context) error {
+	pg.mu.Lock()
+	stop := pg.agitationStop
+	done := pg.agitationDone
+	pg.agitationStop = nil
+	pg.mu.Unlock()
+
+	if stop == nil {
+		return ErrNotAgitating
+	}
+
+	close(stop)
+	pg.hold.release(true)
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Progress of a running agitation cycle
+type AgitationStatus struct {
+	// Empty unless a recipe is running
+	Recipe string
+	Phase  string
+	// Numbered from 1. Zero unless a recipe is running.
+	PhaseNumber int
+	PhaseCount  int
+	// Whether the cycle or the phase has a set length
+	Timed bool
+	// Parked between intervals of agitation
+	Resting bool
+	// Strokes in the phase, or in the cycle if no recipe is running, and the limit on them. A limit of 0 is no limit.
+	Strokes     int
+	StrokeLimit int
+	// Strokes since the cycle started
+	TotalStrokes int
+	// Time left in the phase, or in the cycle if no recipe is running. Stays at 0 while the carriage finishes its
+	// stroke and returns to the centre.
+	Remaining time.Duration
+}
+
+// Progress of the running agitation cycle. Returns false if no cycle is running.
+func (pg *PlateGenie) AgitationStatus() (AgitationStatus, bool) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if pg.agitationDone == nil {
+		return AgitationStatus{}, false
+	}
+	status := pg.agitationStatus
+	if !pg.agitationDeadline.IsZero() {
+		status.Timed = true
+		status.Remaining = time.Until(pg.agitationDeadline)
+		if status.Remaining < 0 {
+			status.Remaining = 0
+		}
+	}
+	return status, true
+}
+
+// Time left in a timed agitation cycle, or in the current phase of a recipe. Returns false if no cycle is running or
+// the cycle is not timed.
+func (pg *PlateGenie) AgitationRemaining() (time.Duration, bool) {
+	status, ok := pg.AgitationStatus()
+	if !ok || !status.Timed {
+		return 0, false
+	}
+	return status.Remaining, true
+}
+
+func (pg *PlateGenie) setResting(resting bool) {
+	pg.mu.Lock()
+	pg.agitationStatus.Resting = resting
+	pg.mu.Unlock()
+}
+
+// Strokes counted so far in the phase, or in the cycle if no recipe is running
+func (pg *PlateGenie) phaseStrokes() int {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	return pg.agitationStatus.Strokes
+}
+
+func (pg *PlateGenie) countStroke() {
+	pg.mu.Lock()
+	pg.agitationStatus.Strokes++
+	pg.agitationStatus.TotalStrokes++
+	pg.mu.Unlock()
+}
+
+// Move on to a new phase. The stroke count for the phase starts again from 0.
+func (pg *PlateGenie) setAgitationStatus(status AgitationStatus, deadline time.Time) {
+	pg.mu.Lock()
+	status.TotalStrokes = pg.agitationStatus.TotalStrokes
+	pg.agitationStatus = status
+	pg.agitationDeadline = deadline
+	pg.mu.Unlock()
+}
+
+// Stop all motion immediately. Motion stays inhibited until ResetEStop is called or the green button is pressed.
+func (pg *PlateGenie) EStop() {
+	pg.state.eStop("Emergency stop requested")
+}
+
+// Clear an emergency stop or a fault. The machine goes back to Idle if it is still homed, and to Unhomed otherwise.
+func (pg *PlateGenie) ResetEStop() error {
+	return pg.state.reset("Emergency stop reset requested")
+}
+
+// Position in steps from the left end of the travel
+func (pg *PlateGenie) Position() int {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	return pg.position
+}
+
+// Number of steps between the two ends of the travel. Zero until the axis has been homed.
+func (pg *PlateGenie) TravelSteps() int {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	return pg.homingStepCount
+}
@@ -24,54 +24,99 @@ WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package main
 
 import (
-	"time"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/the-sibyl/goLCD20x4"
 	"github.com/the-sibyl/plateGenie"
+	"github.com/the-sibyl/plateGenie/pi"
 	"github.com/the-sibyl/softStepper"
 	"github.com/the-sibyl/sysfsGPIO"
 )
 
 func main() {
-	// Set up the display
-	lcd := goLCD20x4.Open(2, 3, 4, 17, 27, 22, 10, 9, 11, 0, 5)
-	defer lcd.Close()
-
-	// GPIO 6, 13, 19, 26 for membrane keypad
-	gpio6, _ := sysfsGPIO.InitPin(6, "in")
-	defer gpio6.ReleasePin()
-
-	gpio13, _ := sysfsGPIO.InitPin(13, "in")
-	defer gpio13.ReleasePin()
-
-	gpio19, _ := sysfsGPIO.InitPin(19, "in")
-	defer gpio19.ReleasePin()
-
-	gpio26, _ := sysfsGPIO.InitPin(26, "in")
-	defer gpio26.ReleasePin()
-
-	// GPIO 18 for the green button and GPIO 23 for the red button
-	gpio18, _ := sysfsGPIO.InitPin(18, "in")
-	defer gpio18.ReleasePin()
+	if err := run(); err != nil {
+		fmt.Println(err)
+		// Let systemd see the failure
+		os.Exit(1)
+	}
+}
 
-	gpio23, _ := sysfsGPIO.InitPin(23, "in")
-	defer gpio23.ReleasePin()
+// Everything that needs cleaning up is deferred in here, so that it is done before main exits
+func run() error {
+	configPath := flag.String("config", "", "JSON configuration file. The built-in defaults are used if not given.")
+	settingsPath := flag.String("settings", "",
+		"File for the settings changed from the menu in place of settingsFile in the configuration. Empty to "+
+			"always start with the defaults.")
+	flag.Parse()
+
+	cfg := plateGenie.DefaultConfig()
+	if *configPath != "" {
+		var err error
+		cfg, err = plateGenie.LoadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+	}
+	// Only when given, so that an empty settingsFile in the configuration still turns persistence off
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "settings" {
+			cfg.SettingsFile = *settingsPath
+		}
+	})
+	pins := cfg.Pins
 
-	// GPIO 21 for left limit switch. GPIO 16 for right limit switch.
-	// Pull-ups are defined in the device tree overlay.
-	gpio21, _ := sysfsGPIO.InitPin(21, "in")
-	defer gpio21.ReleasePin()
+	// Set up the display
+	l := pins.LCD
+	lcd := goLCD20x4.Open(l[0], l[1], l[2], l[3], l[4], l[5], l[6], l[7], l[8], l[9], l[10])
+	defer lcd.Close()
 
-	gpio16, _ := sysfsGPIO.InitPin(16, "in")
-	defer gpio16.ReleasePin()
+	// Membrane keypad, buttons and limit switches. Pull-ups for the limit switches are defined in the device tree
+	// overlay.
+	var inputs []plateGenie.InputPin
+	// Until Initialize succeeds the pins have to be released here
+	releaseInputs := func() {
+		for _, pin := range inputs {
+			pin.ReleasePin()
+		}
+	}
+	for _, num := range []int{pins.Membrane[0], pins.Membrane[1], pins.Membrane[2], pins.Membrane[3],
+		pins.RedButton, pins.GreenButton, pins.LeftLimit, pins.RightLimit} {
+		pin, err := sysfsGPIO.InitPin(num, "in")
+		if err != nil {
+			releaseInputs()
+			return err
+		}
+		inputs = append(inputs, pi.NewSysfsPin(pin))
+	}
 
-	// Set this to the minimum reasonable time (on the order of 1 ms) to give the most options for speed
-	const stepperSpeed = 1500
-	stepper := softStepper.InitStepperTwoEnaPins(24, 12, 25, 8, 7, 1, time.Microsecond*stepperSpeed)
+	st := pins.Stepper
+	stepper := softStepper.InitStepperTwoEnaPins(st[0], st[1], st[2], st[3], st[4], st[5], cfg.StepperPulse())
+
+	// The pins are released by pg.Close()
+	pg, err := plateGenie.Initialize(&cfg, pi.NewLCDDisplay(lcd),
+		inputs[0], inputs[1], inputs[2], inputs[3],
+		inputs[4], inputs[5],
+		inputs[6], inputs[7],
+		pi.NewSysfsInterruptSource(), pi.NewSoftStepperDriver(stepper))
+	if err != nil {
+		releaseInputs()
+		return err
+	}
+	defer pg.Close()
 
-	plateGenie.Initialize(lcd, gpio19, gpio26, gpio6, gpio13, gpio23, gpio18, gpio21, gpio16, stepper)
+	// Shut down cleanly on Ctrl-C or when systemd stops the service
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for {
-		time.Sleep(time.Second)
+	// Cancelled by the signal is a clean shutdown
+	if err := pg.Run(ctx); !errors.Is(err, context.Canceled) {
+		return err
 	}
+	return nil
 }
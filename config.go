@@ -0,0 +1,276 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// Highest GPIO number on the Raspberry Pi header
+	maxGPIONum = 27
+	// Limits for the stepper pulse duration in microseconds
+	minStepperPulse = 100
+	maxStepperPulse = 100000
+	// Limit for the homing delay and the debounce time in microseconds
+	maxDelay = 10000000
+)
+
+// Configuration for one rig: the wiring, the motion constants and the settings used on power-up. Every field has a
+// default, so a configuration file only has to contain what differs from DefaultConfig().
+type Config struct {
+	Pins     PinConfig     `json:"pins"`
+	Stepper  StepperConfig `json:"stepper"`
+	Homing   HomingConfig  `json:"homing"`
+	SCurve   SCurveConfig  `json:"sCurve"`
+	Defaults Settings      `json:"defaults"`
+	// File where the settings changed from the menu are saved and restored from on startup. Empty to always start
+	// with the defaults.
+	SettingsFile string `json:"settingsFile"`
+	// Directory of recipe files, checked for changes while running. Empty for no recipes.
+	RecipeDir string `json:"recipeDir"`
+	// File that every agitation cycle is appended to as a line of JSON. Empty to only keep the history in memory.
+	HistoryFile string `json:"historyFile"`
+	// Debounce time for key presses in microseconds
+	DebounceMicroseconds int `json:"debounceMicroseconds"`
+}
+
+// BCM GPIO numbers
+type PinConfig struct {
+	// In the order taken by goLCD20x4.Open()
+	LCD []int `json:"lcd"`
+	// Membrane keys 1 through 4: previous, soft key 1, soft key 2, next
+	Membrane    []int `json:"membrane"`
+	RedButton   int   `json:"redButton"`
+	GreenButton int   `json:"greenButton"`
+	LeftLimit   int   `json:"leftLimit"`
+	RightLimit  int   `json:"rightLimit"`
+	// In the order taken by softStepper.InitStepperTwoEnaPins()
+	Stepper []int `json:"stepper"`
+}
+
+type StepperConfig struct {
+	// Time taken by one step at full speed. Set this to the minimum reasonable time (on the order of 1 ms) to give
+	// the most options for speed.
+	PulseMicroseconds int `json:"pulseMicroseconds"`
+	// Steps per mm of carriage travel, from the pulley and the microstepping. 0 if the rig is not calibrated, which
+	// leaves only the percentages.
+	StepsPerMm float64 `json:"stepsPerMm"`
+}
+
+type HomingConfig struct {
+	// Maximum number of steps to be traversed for an axis move on a homing operation
+	MaxSteps int `json:"maxSteps"`
+	// Number of steps to back-off in a homing operation
+	BackoffSteps int `json:"backoffSteps"`
+	// Delay to slow down the stepper for homing movements in addition to the stepper pulse duration
+	StepDelayMicroseconds int `json:"stepDelayMicroseconds"`
+}
+
+// Limits of the S-curve profile. Its speed is a percentage of the maximum stepper speed like for the other profiles.
+type SCurveConfig struct {
+	// Steps per second squared
+	MaxAcceleration int `json:"maxAcceleration"`
+	// Steps per second cubed
+	Jerk int `json:"jerk"`
+}
+
+// The configuration of the original PlateGenie build
+func DefaultConfig() Config {
+	return Config{
+		Pins: PinConfig{
+			LCD:         []int{2, 3, 4, 17, 27, 22, 10, 9, 11, 0, 5},
+			Membrane:    []int{19, 26, 6, 13},
+			RedButton:   23,
+			GreenButton: 18,
+			LeftLimit:   21,
+			RightLimit:  16,
+			Stepper:     []int{24, 12, 25, 8, 7, 1},
+		},
+		Stepper: StepperConfig{
+			PulseMicroseconds: defaultStepperPulse,
+		},
+		Homing: HomingConfig{
+			MaxSteps:              defaultMaxHomingSteps,
+			BackoffSteps:          defaultBackoffSteps,
+			StepDelayMicroseconds: defaultHomingStepDelay,
+		},
+		SCurve: SCurveConfig{
+			MaxAcceleration: defaultSCurveAcceleration,
+			Jerk:            defaultSCurveJerk,
+		},
+		Defaults:             defaultSettings(),
+		DebounceMicroseconds: defaultDebounceTime,
+	}
+}
+
+// Read a JSON configuration file on top of the defaults and validate it
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// Every problem found in a configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "Invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Check the pins for conflicts and the constants for out of range values
+func (cfg Config) Validate() error {
+	var problems []string
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	// Pin numbers and conflicts
+	if len(cfg.Pins.LCD) != 11 {
+		problem("pins.lcd needs 11 pins, got %d", len(cfg.Pins.LCD))
+	}
+	if len(cfg.Pins.Membrane) != 4 {
+		problem("pins.membrane needs 4 pins, got %d", len(cfg.Pins.Membrane))
+	}
+	if len(cfg.Pins.Stepper) != 6 {
+		problem("pins.stepper needs 6 pins, got %d", len(cfg.Pins.Stepper))
+	}
+
+	users := make(map[int][]string)
+	use := func(name string, pin int) {
+		if pin < 0 || pin > maxGPIONum {
+			problem("%s: GPIO %d is out of range [0, %d]", name, pin, maxGPIONum)
+			return
+		}
+		users[pin] = append(users[pin], name)
+	}
+	for k, pin := range cfg.Pins.LCD {
+		use(fmt.Sprintf("pins.lcd[%d]", k), pin)
+	}
+	for k, pin := range cfg.Pins.Membrane {
+		use(fmt.Sprintf("pins.membrane[%d]", k), pin)
+	}
+	use("pins.redButton", cfg.Pins.RedButton)
+	use("pins.greenButton", cfg.Pins.GreenButton)
+	use("pins.leftLimit", cfg.Pins.LeftLimit)
+	use("pins.rightLimit", cfg.Pins.RightLimit)
+	for k, pin := range cfg.Pins.Stepper {
+		use(fmt.Sprintf("pins.stepper[%d]", k), pin)
+	}
+
+	var conflicts []int
+	for pin, names := range users {
+		if len(names) > 1 {
+			conflicts = append(conflicts, pin)
+		}
+	}
+	sort.Ints(conflicts)
+	for _, pin := range conflicts {
+		problem("GPIO %d is used by %s", pin, strings.Join(users[pin], ", "))
+	}
+
+	// Constants
+	if cfg.Stepper.PulseMicroseconds < minStepperPulse || cfg.Stepper.PulseMicroseconds > maxStepperPulse {
+		problem("stepper.pulseMicroseconds %d is out of range [%d, %d]", cfg.Stepper.PulseMicroseconds,
+			minStepperPulse, maxStepperPulse)
+	}
+	if cfg.Stepper.StepsPerMm < 0 || math.IsNaN(cfg.Stepper.StepsPerMm) || math.IsInf(cfg.Stepper.StepsPerMm, 0) {
+		problem("stepper.stepsPerMm %g must be 0 or more", cfg.Stepper.StepsPerMm)
+	}
+	if cfg.Homing.MaxSteps < 1 {
+		problem("homing.maxSteps %d must be at least 1", cfg.Homing.MaxSteps)
+	}
+	if cfg.Homing.BackoffSteps < 0 || cfg.Homing.BackoffSteps >= cfg.Homing.MaxSteps {
+		problem("homing.backoffSteps %d is out of range [0, %d)", cfg.Homing.BackoffSteps, cfg.Homing.MaxSteps)
+	}
+	if cfg.Homing.StepDelayMicroseconds < 0 || cfg.Homing.StepDelayMicroseconds > maxDelay {
+		problem("homing.stepDelayMicroseconds %d is out of range [0, %d]", cfg.Homing.StepDelayMicroseconds,
+			maxDelay)
+	}
+	if cfg.SCurve.MaxAcceleration < 1 {
+		problem("sCurve.maxAcceleration %d must be at least 1", cfg.SCurve.MaxAcceleration)
+	}
+	if cfg.SCurve.Jerk < 1 {
+		problem("sCurve.jerk %d must be at least 1", cfg.SCurve.Jerk)
+	}
+	if err := cfg.Defaults.Validate(); err != nil {
+		problem("defaults: %v", err)
+	} else if err := cfg.Defaults.checkCalibration(cfg.Stepper.StepsPerMm); err != nil {
+		problem("defaults: %v", err)
+	}
+	if cfg.DebounceMicroseconds < 0 || cfg.DebounceMicroseconds > maxDelay {
+		problem("debounceMicroseconds %d is out of range [0, %d]", cfg.DebounceMicroseconds, maxDelay)
+	}
+
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// Stepper pulse duration
+func (cfg Config) StepperPulse() time.Duration {
+	return time.Microsecond * time.Duration(cfg.Stepper.PulseMicroseconds)
+}
+
+func (cfg Config) homingStepDelay() time.Duration {
+	return time.Microsecond * time.Duration(cfg.Homing.StepDelayMicroseconds)
+}
+
+func (cfg Config) debounceTime() time.Duration {
+	return time.Microsecond * time.Duration(cfg.DebounceMicroseconds)
+}
+
+// Configuration in use
+func (pg *PlateGenie) Config() Config {
+	cfg := pg.config
+	cfg.Pins.LCD = append([]int(nil), cfg.Pins.LCD...)
+	cfg.Pins.Membrane = append([]int(nil), cfg.Pins.Membrane...)
+	cfg.Pins.Stepper = append([]int(nil), cfg.Pins.Stepper...)
+	return cfg
+}
@@ -0,0 +1,89 @@
+package plateGenie
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigExample(t *testing.T) {
+	cfg, err := LoadConfig("app/plategenie.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := DefaultConfig()
+	if cfg.Homing != def.Homing || cfg.SCurve != def.SCurve || cfg.Defaults != def.Defaults {
+		t.Errorf("Example configuration differs from the defaults: %+v", cfg)
+	}
+}
+
+func TestConfigProblems(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Pins.RedButton = cfg.Pins.Membrane[0]
+	cfg.Pins.LeftLimit = 40
+	cfg.Pins.LCD = cfg.Pins.LCD[:1]
+	cfg.Homing.BackoffSteps = -1
+	cfg.Defaults.SpeedPercentage = 0
+
+	var cfgErr *ConfigError
+	if err := cfg.Validate(); !errors.As(err, &cfgErr) {
+		t.Fatalf("Got %v, want a ConfigError", err)
+	}
+	for _, want := range []string{
+		"GPIO 19 is used by pins.membrane[0], pins.redButton",
+		"pins.leftLimit: GPIO 40 is out of range",
+		"pins.lcd needs 11 pins, got 1",
+		"homing.backoffSteps -1 is out of range",
+		"defaults: ",
+	} {
+		found := false
+		for _, p := range cfgErr.Problems {
+			found = found || strings.HasPrefix(p, want)
+		}
+		if !found {
+			t.Errorf("No problem starting %q in %q", want, cfgErr.Problems)
+		}
+	}
+}
+
+func TestConfigDecodeErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plategenie.json")
+
+	// Misspelled keys are not ignored
+	if err := ioutil.WriteFile(path, []byte(`{"pinz": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.HasPrefix(err.Error(), path) {
+		t.Errorf("Unknown field: got %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"homing": {"maxSteps": "many"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if _, err := LoadConfig(path); !errors.As(err, &typeErr) {
+		t.Errorf("Wrong type: got %v, want a json.UnmarshalTypeError", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"homing": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("Truncated file loaded")
+	}
+}
+
+func TestConfigDefaultsInMm(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Defaults.TravelMm = 50
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "defaults: "+ErrNotCalibrated.Error()) {
+		t.Errorf("Uncalibrated: got %v", err)
+	}
+	cfg.Stepper.StepsPerMm = 80
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Calibrated: %v", err)
+	}
+}
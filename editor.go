@@ -0,0 +1,926 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The recipe editor is a Screen driven by the four membrane keys. The arrow keys move through a list or move the
+// cursor, and the two soft keys act on what is showing. Every confirmed change is saved to the recipe directory right
+// away, and the directory is reloaded so that the Recipes menu item sees it.
+//
+// Recipes: OPEN or NEW, EXIT
+//   Recipe: Phases, Rename, Copy, Delete
+//     Phases: OK or ADD, BACK
+//       Phase: Edit, Copy, Delete
+//         Fields: Name, Time, Strokes, Speed, Travel, Const. speed, Speed mm/s, Travel mm, Accel mm/s2, Dwell,
+//                 Profile, Pattern, Agitate, Interval, Release coils, Min speed, Min travel, Min dwell,
+//                 Min speed mm/s, Min travel mm
+
+const (
+	// Longest name that can be entered on the keypad
+	maxEditedNameLength = 16
+	// Characters offered for names, in order
+	nameCharacters = " ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-+.#"
+	// Time given to a new phase in seconds
+	newPhaseSeconds = 60
+	// Agitation and interval given to a new phase in seconds, used if the pattern is changed to interval
+	newPhaseAgitateSeconds  = 10
+	newPhaseIntervalSeconds = 60
+)
+
+type editorMode int
+
+const (
+	editRecipes editorMode = iota
+	editRecipe
+	editPhases
+	editPhase
+	editFields
+	editNumber
+	editText
+	editChoice
+	editConfirm
+)
+
+var (
+	recipeActions = []string{"Phases", "Rename", "Copy", "Delete"}
+	phaseActions  = []string{"Edit", "Copy", "Delete"}
+	phaseFields   = []string{"Name", "Time", "Strokes", "Speed", "Travel", "Const. speed", "Speed mm/s", "Travel mm",
+		"Accel mm/s2", "Dwell", "Profile", "Pattern", "Agitate", "Interval", "Release coils", "Min speed", "Min travel",
+		"Min dwell", "Min speed mm/s", "Min travel mm"}
+	yesNo = []string{"No", "Yes"}
+)
+
+// Indices into phaseFields
+const (
+	fieldName = iota
+	fieldTime
+	fieldStrokes
+	fieldSpeed
+	fieldTravel
+	fieldConstantSpeed
+	fieldSpeedMm
+	fieldTravelMm
+	fieldAccelerationMm
+	fieldDwell
+	fieldProfile
+	fieldPattern
+	fieldAgitate
+	fieldInterval
+	fieldReleaseCoils
+	fieldMinSpeed
+	fieldMinTravel
+	fieldMinDwell
+	fieldMinSpeedMm
+	fieldMinTravelMm
+)
+
+type recipeEditor struct {
+	pg *PlateGenie
+
+	// The fields below are only used by KeyPressed, which is never called for two keys at once
+	mode editorMode
+	// Position in the list showing
+	index int
+	// Recipe being edited, as last saved, and its file
+	recipe Recipe
+	path   string
+	// Phase and field being edited
+	phase int
+	field int
+	// Entry for numbers and names
+	buffer []byte
+	cursor int
+	// true while renaming the recipe rather than a phase
+	renaming bool
+	// Pattern or yes/no being chosen
+	choices []string
+	choice  int
+	// Asked before deleting
+	question    string
+	confirm     func()
+	confirmBack editorMode
+	// Shown on the third line until the next key press
+	message string
+
+	// Lines painted on the display, updated at the end of every key press
+	linesMu sync.Mutex
+	lines   [4]string
+}
+
+// Start the recipe editor on the list of recipes
+func (pg *PlateGenie) openRecipeEditor() {
+	e := &recipeEditor{pg: pg}
+	if pg.config.RecipeDir == "" {
+		e.message = "No recipe directory"
+	}
+	e.update()
+	pg.menu.OpenScreen(e)
+}
+
+func (e *recipeEditor) Paint(lcd Display) {
+	e.linesMu.Lock()
+	defer e.linesMu.Unlock()
+	lcd.WriteLineCentered(e.lines[0], 1)
+	lcd.WriteLineCentered(e.lines[1], 2)
+	lcd.WriteLineCentered(e.lines[2], 3)
+	lcd.WriteLine(e.lines[3], 4)
+}
+
+func (e *recipeEditor) KeyPressed(key int) {
+	e.message = ""
+	closing := false
+
+	switch e.mode {
+	case editRecipes:
+		closing = e.recipesKey(key)
+	case editRecipe:
+		e.recipeKey(key)
+	case editPhases:
+		e.phasesKey(key)
+	case editPhase:
+		e.phaseKey(key)
+	case editFields:
+		e.fieldsKey(key)
+	case editNumber:
+		e.numberKey(key)
+	case editText:
+		e.textKey(key)
+	case editChoice:
+		e.choiceKey(key)
+	case editConfirm:
+		e.confirmKey(key)
+	}
+
+	if closing {
+		e.pg.menu.CloseScreen()
+		return
+	}
+	e.update()
+}
+
+// Move through a list of n entries with the arrow keys. Returns false for the soft keys.
+func (e *recipeEditor) scroll(key int, n int) bool {
+	switch key {
+	case 1:
+		e.index = (e.index + n - 1) % n
+	case 4:
+		e.index = (e.index + 1) % n
+	default:
+		return false
+	}
+	return true
+}
+
+// ----------------
+// Lists of entries
+// ----------------
+
+func (e *recipeEditor) recipesKey(key int) bool {
+	recipes, paths := e.pg.recipeFiles()
+	entries := len(recipes)
+	if e.pg.config.RecipeDir != "" {
+		// New recipe
+		entries++
+	}
+	if entries == 0 {
+		return key == 3
+	}
+	if e.scroll(key, entries) {
+		return false
+	}
+	if key == 3 {
+		return true
+	}
+
+	if e.index >= len(recipes) {
+		e.newRecipe()
+		return false
+	}
+	e.recipe = recipes[e.index]
+	e.path = paths[e.index]
+	e.mode = editRecipe
+	e.index = 0
+	return false
+}
+
+func (e *recipeEditor) recipeKey(key int) {
+	if e.scroll(key, len(recipeActions)) {
+		return
+	}
+	if key == 3 {
+		e.backToRecipes()
+		return
+	}
+
+	switch recipeActions[e.index] {
+	case "Phases":
+		e.mode = editPhases
+		e.index = 0
+	case "Rename":
+		e.startText(e.recipe.Name, true)
+	case "Copy":
+		e.copyRecipe()
+	case "Delete":
+		e.ask("Delete recipe?", editRecipe, func() {
+			if err := os.Remove(e.path); err != nil {
+				e.fail(err)
+				return
+			}
+			fmt.Println("Deleted recipe", e.recipe.Name)
+			e.pg.loadRecipeDir()
+			e.mode = editRecipes
+			e.index = 0
+		})
+	}
+}
+
+func (e *recipeEditor) phasesKey(key int) {
+	// The last entry adds a phase
+	if e.scroll(key, len(e.recipe.Phases)+1) {
+		return
+	}
+	if key == 3 {
+		e.mode = editRecipe
+		e.index = 0
+		return
+	}
+
+	if e.index == len(e.recipe.Phases) {
+		s := e.pg.Settings()
+		r := e.recipe.clone()
+		r.Phases = append(r.Phases, Phase{
+			Name:                    "PHASE " + strconv.Itoa(len(r.Phases)+1),
+			Seconds:                 newPhaseSeconds,
+			SpeedPercentage:         s.SpeedPercentage,
+			ConstantSpeedPercentage: s.ConstantSpeedPercentage,
+			TravelPercentage:        s.TravelPercentage,
+			Pattern:                 PatternContinuous,
+			AgitateSeconds:          newPhaseAgitateSeconds,
+			IntervalSeconds:         newPhaseIntervalSeconds,
+		})
+		if e.save(r) {
+			e.phase = len(r.Phases) - 1
+			e.mode = editFields
+			e.index = 0
+		}
+		return
+	}
+	e.phase = e.index
+	e.mode = editPhase
+	e.index = 0
+}
+
+func (e *recipeEditor) phaseKey(key int) {
+	if e.scroll(key, len(phaseActions)) {
+		return
+	}
+	if key == 3 {
+		e.backToPhases()
+		return
+	}
+
+	switch phaseActions[e.index] {
+	case "Edit":
+		e.mode = editFields
+		e.index = 0
+	case "Copy":
+		r := e.recipe.clone()
+		p := r.Phases[e.phase]
+		r.Phases = append(r.Phases[:e.phase+1], append([]Phase{p}, r.Phases[e.phase+1:]...)...)
+		if e.save(r) {
+			e.phase++
+			e.message = "Phase copied"
+		}
+	case "Delete":
+		if len(e.recipe.Phases) == 1 {
+			e.message = "Last phase"
+			return
+		}
+		e.ask("Delete phase?", editPhase, func() {
+			r := e.recipe.clone()
+			r.Phases = append(r.Phases[:e.phase], r.Phases[e.phase+1:]...)
+			if e.save(r) {
+				if e.phase >= len(r.Phases) {
+					e.phase = len(r.Phases) - 1
+				}
+				e.backToPhases()
+			}
+		})
+	}
+}
+
+func (e *recipeEditor) fieldsKey(key int) {
+	if e.scroll(key, len(phaseFields)) {
+		return
+	}
+	if key == 3 {
+		e.mode = editPhase
+		e.index = 0
+		return
+	}
+
+	e.field = e.index
+	p := e.recipe.Phases[e.phase]
+	switch e.field {
+	case fieldName:
+		e.startText(p.Name, false)
+	case fieldTime:
+		e.startNumber(fmt.Sprintf("%02d%02d", p.Seconds/60, p.Seconds%60))
+	case fieldStrokes:
+		e.startNumber(fmt.Sprintf("%04d", p.Strokes))
+	case fieldAgitate:
+		e.startNumber(fmt.Sprintf("%02d%02d", p.AgitateSeconds/60, p.AgitateSeconds%60))
+	case fieldInterval:
+		e.startNumber(fmt.Sprintf("%02d%02d", p.IntervalSeconds/60, p.IntervalSeconds%60))
+	case fieldSpeed:
+		e.startNumber(fmt.Sprintf("%03d", p.SpeedPercentage))
+	case fieldTravel:
+		e.startNumber(fmt.Sprintf("%03d", p.TravelPercentage))
+	case fieldConstantSpeed:
+		e.startNumber(fmt.Sprintf("%03d", p.ConstantSpeedPercentage))
+	case fieldDwell:
+		e.startNumber(fmt.Sprintf("%04d", p.DwellMilliseconds))
+	case fieldMinSpeed:
+		e.startNumber(fmt.Sprintf("%03d", p.MinSpeedPercentage))
+	case fieldMinTravel:
+		e.startNumber(fmt.Sprintf("%03d", p.MinTravelPercentage))
+	case fieldMinDwell:
+		e.startNumber(fmt.Sprintf("%04d", p.MinDwellMilliseconds))
+	case fieldSpeedMm:
+		e.startNumber(formatTenths(p.SpeedMmPerSecond, 5))
+	case fieldTravelMm:
+		e.startNumber(formatTenths(p.TravelMm, 5))
+	case fieldAccelerationMm:
+		e.startNumber(formatTenths(p.AccelerationMmPerSecond2, 6))
+	case fieldMinSpeedMm:
+		e.startNumber(formatTenths(p.MinSpeedMmPerSecond, 5))
+	case fieldMinTravelMm:
+		e.startNumber(formatTenths(p.MinTravelMm, 5))
+	case fieldProfile:
+		e.choices = nil
+		e.choice = 0
+		for k, profile := range profiles {
+			e.choices = append(e.choices, string(profile))
+			if profile == p.Profile {
+				e.choice = k
+			}
+		}
+		e.mode = editChoice
+	case fieldPattern:
+		e.choices = nil
+		e.choice = 0
+		for k, pattern := range patterns {
+			e.choices = append(e.choices, string(pattern))
+			if pattern == p.Pattern {
+				e.choice = k
+			}
+		}
+		e.mode = editChoice
+	case fieldReleaseCoils:
+		e.choices = yesNo
+		e.choice = boolIndex(p.ReleaseCoils)
+		e.mode = editChoice
+	}
+}
+
+// -------
+// Entries
+// -------
+
+func (e *recipeEditor) startNumber(digits string) {
+	e.buffer = []byte(digits)
+	e.cursor = 0
+	e.mode = editNumber
+}
+
+// The arrows move the cursor, the first soft key counts the digit under it up and the second one saves
+func (e *recipeEditor) numberKey(key int) {
+	switch key {
+	case 1:
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case 4:
+		if e.cursor < len(e.buffer)-1 {
+			e.cursor++
+		}
+	case 2:
+		limit := byte(10)
+		if isTimeField(e.field) && e.cursor == 2 {
+			// Tens of seconds
+			limit = 6
+		}
+		e.buffer[e.cursor] = '0' + (e.buffer[e.cursor]-'0'+1)%limit
+	case 3:
+		value, _ := strconv.Atoi(string(e.buffer))
+		if isTimeField(e.field) {
+			value = value/100*60 + value%100
+		}
+		e.setField(func(p *Phase) {
+			switch e.field {
+			case fieldTime:
+				p.Seconds = value
+			case fieldStrokes:
+				p.Strokes = value
+			case fieldSpeed:
+				p.SpeedPercentage = value
+			case fieldTravel:
+				p.TravelPercentage = value
+			case fieldConstantSpeed:
+				p.ConstantSpeedPercentage = value
+			case fieldDwell:
+				p.DwellMilliseconds = value
+			case fieldMinSpeed:
+				p.MinSpeedPercentage = value
+			case fieldMinTravel:
+				p.MinTravelPercentage = value
+			case fieldMinDwell:
+				p.MinDwellMilliseconds = value
+			case fieldSpeedMm:
+				p.SpeedMmPerSecond = float64(value) / 10
+			case fieldTravelMm:
+				p.TravelMm = float64(value) / 10
+			case fieldAccelerationMm:
+				p.AccelerationMmPerSecond2 = float64(value) / 10
+			case fieldMinSpeedMm:
+				p.MinSpeedMmPerSecond = float64(value) / 10
+			case fieldMinTravelMm:
+				p.MinTravelMm = float64(value) / 10
+			case fieldAgitate:
+				p.AgitateSeconds = value
+			case fieldInterval:
+				p.IntervalSeconds = value
+			}
+		})
+	}
+}
+
+func (e *recipeEditor) startText(text string, renaming bool) {
+	text = strings.ToUpper(text)
+	if len(text) > maxEditedNameLength {
+		text = text[:maxEditedNameLength]
+	}
+	e.buffer = []byte(text + strings.Repeat(" ", maxEditedNameLength-len(text)))
+	e.cursor = 0
+	e.renaming = renaming
+	e.mode = editText
+}
+
+// The arrows move the cursor, the first soft key steps through the characters and the second one saves
+func (e *recipeEditor) textKey(key int) {
+	switch key {
+	case 1:
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case 4:
+		if e.cursor < len(e.buffer)-1 {
+			e.cursor++
+		}
+	case 2:
+		next := strings.IndexByte(nameCharacters, e.buffer[e.cursor]) + 1
+		e.buffer[e.cursor] = nameCharacters[next%len(nameCharacters)]
+	case 3:
+		name := strings.TrimSpace(string(e.buffer))
+		if name == "" {
+			e.message = "Name is empty"
+			return
+		}
+		if !e.renaming {
+			e.setField(func(p *Phase) { p.Name = name })
+			return
+		}
+		r := e.recipe.clone()
+		r.Name = name
+		if e.save(r) {
+			e.mode = editRecipe
+			e.index = 0
+		}
+	}
+}
+
+func (e *recipeEditor) choiceKey(key int) {
+	switch key {
+	case 1:
+		e.choice = (e.choice + len(e.choices) - 1) % len(e.choices)
+	case 2, 4:
+		e.choice = (e.choice + 1) % len(e.choices)
+	case 3:
+		switch e.field {
+		case fieldReleaseCoils:
+			e.setField(func(p *Phase) { p.ReleaseCoils = e.choice == 1 })
+		case fieldProfile:
+			e.setField(func(p *Phase) { p.Profile = profiles[e.choice] })
+		default:
+			e.setField(func(p *Phase) {
+				p.Pattern = patterns[e.choice]
+				// Start a new random phase with half of its settings as the lower bounds
+				if p.Pattern == PatternRandom && p.MinSpeedPercentage == 0 && p.MinTravelPercentage == 0 {
+					p.MinSpeedPercentage = (p.SpeedPercentage + 1) / 2
+					p.MinTravelPercentage = (p.TravelPercentage + 1) / 2
+					p.MinDwellMilliseconds = p.DwellMilliseconds / 2
+					p.MinSpeedMmPerSecond = p.SpeedMmPerSecond / 2
+					p.MinTravelMm = p.TravelMm / 2
+				}
+			})
+		}
+	}
+}
+
+func (e *recipeEditor) ask(question string, back editorMode, confirm func()) {
+	e.question = question
+	e.confirm = confirm
+	e.confirmBack = back
+	e.mode = editConfirm
+}
+
+func (e *recipeEditor) confirmKey(key int) {
+	switch key {
+	case 2:
+		e.confirm()
+	case 3:
+		e.mode = e.confirmBack
+		e.index = 0
+	}
+}
+
+// ------
+// Saving
+// ------
+
+// Change the phase being edited and save the recipe. Goes back to the list of fields if the change is valid.
+func (e *recipeEditor) setField(change func(p *Phase)) {
+	r := e.recipe.clone()
+	change(&r.Phases[e.phase])
+	if err := r.Phases[e.phase].validate(); err != nil {
+		e.fail(err)
+		return
+	}
+	if e.save(r) {
+		e.mode = editFields
+		e.index = e.field
+	}
+}
+
+// Save the recipe to its file and reload the recipe directory. Returns false, with the reason on the display, if the
+// recipe could not be saved.
+func (e *recipeEditor) save(r Recipe) bool {
+	recipes, paths := e.pg.recipeFiles()
+	for k, other := range recipes {
+		if other.Name == r.Name && paths[k] != e.path {
+			e.message = "Name already used"
+			return false
+		}
+	}
+	if err := SaveRecipe(e.path, r); err != nil {
+		e.fail(err)
+		return false
+	}
+	fmt.Println("Saved recipe", r.Name, "to", e.path)
+
+	e.recipe = r
+	e.pg.loadRecipeDir()
+	return true
+}
+
+func (e *recipeEditor) newRecipe() {
+	s := e.pg.Settings()
+	name := e.unusedName("NEW RECIPE")
+	r := Recipe{
+		Name: name,
+		Phases: []Phase{{
+			Name:                    "PHASE 1",
+			Seconds:                 newPhaseSeconds,
+			SpeedPercentage:         s.SpeedPercentage,
+			ConstantSpeedPercentage: s.ConstantSpeedPercentage,
+			TravelPercentage:        s.TravelPercentage,
+			Pattern:                 PatternContinuous,
+			AgitateSeconds:          newPhaseAgitateSeconds,
+			IntervalSeconds:         newPhaseIntervalSeconds,
+		}},
+	}
+	e.path = e.unusedPath(name)
+	if e.save(r) {
+		e.mode = editRecipe
+		e.index = 0
+	}
+}
+
+func (e *recipeEditor) copyRecipe() {
+	r := e.recipe.clone()
+	r.Name = e.unusedName(r.Name + " COPY")
+	path := e.unusedPath(r.Name)
+
+	previous := e.path
+	e.path = path
+	if !e.save(r) {
+		e.path = previous
+		return
+	}
+	e.message = "Editing the copy"
+}
+
+// A recipe name that is not loaded yet, made by adding a number if needed
+func (e *recipeEditor) unusedName(name string) string {
+	recipes, _ := e.pg.recipeFiles()
+	used := make(map[string]bool)
+	for _, r := range recipes {
+		used[r.Name] = true
+	}
+
+	candidate := name
+	for n := 2; used[candidate]; n++ {
+		candidate = name + " " + strconv.Itoa(n)
+	}
+	return candidate
+}
+
+// A file in the recipe directory that does not exist yet, named after the recipe
+func (e *recipeEditor) unusedPath(name string) string {
+	var slug []byte
+	for _, c := range []byte(strings.ToLower(name)) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			slug = append(slug, c)
+		} else if len(slug) > 0 && slug[len(slug)-1] != '-' {
+			slug = append(slug, '-')
+		}
+	}
+	base := strings.TrimSuffix(string(slug), "-")
+	if base == "" {
+		base = "recipe"
+	}
+
+	path := filepath.Join(e.pg.config.RecipeDir, base+".json")
+	for n := 2; ; n++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(e.pg.config.RecipeDir, base+"-"+strconv.Itoa(n)+".json")
+	}
+}
+
+// Show why something failed in the space available
+func (e *recipeEditor) fail(err error) {
+	fmt.Println(err)
+	var rangeErr *RangeError
+	if errors.As(err, &rangeErr) {
+		e.message = fmt.Sprintf("Use %d to %d", rangeErr.Min, rangeErr.Max)
+		return
+	}
+	e.message = err.Error()
+}
+
+func (e *recipeEditor) backToRecipes() {
+	e.mode = editRecipes
+	e.index = 0
+	recipes, _ := e.pg.recipeFiles()
+	for k, r := range recipes {
+		if r.Name == e.recipe.Name {
+			e.index = k
+		}
+	}
+}
+
+func (e *recipeEditor) backToPhases() {
+	e.mode = editPhases
+	e.index = e.phase
+}
+
+// --------
+// Painting
+// --------
+
+// Work out the four lines for the current mode
+func (e *recipeEditor) update() {
+	var lines [4]string
+	adj1, adj2 := "  OK   ", " BACK  "
+
+	switch e.mode {
+	case editRecipes:
+		recipes, _ := e.pg.recipeFiles()
+		lines[0] = "Recipe Editor"
+		adj2 = " EXIT  "
+		switch {
+		case e.index < len(recipes):
+			r := recipes[e.index]
+			lines[1] = r.Name
+			lines[2] = fmt.Sprintf("%d phases %s", len(r.Phases), formatMinSec(r.totalSeconds()))
+			adj1 = " OPEN  "
+		case e.pg.config.RecipeDir != "":
+			lines[1] = "New recipe"
+			adj1 = "  NEW  "
+		default:
+			adj1 = ""
+		}
+	case editRecipe:
+		lines[0] = e.recipe.Name
+		lines[1] = recipeActions[e.index]
+	case editPhases:
+		lines[0] = e.recipe.Name
+		if e.index < len(e.recipe.Phases) {
+			p := e.recipe.Phases[e.index]
+			lines[1] = fmt.Sprintf("%d/%d %s", e.index+1, len(e.recipe.Phases), p.Name)
+			lines[2] = formatMinSec(p.Seconds) + " " + string(p.Pattern)
+		} else {
+			lines[1] = "Add phase"
+			adj1 = "  ADD  "
+		}
+	case editPhase:
+		lines[0] = fmt.Sprintf("%d/%d %s", e.phase+1, len(e.recipe.Phases), e.recipe.Phases[e.phase].Name)
+		lines[1] = phaseActions[e.index]
+	case editFields:
+		p := e.recipe.Phases[e.phase]
+		lines[0] = p.Name
+		lines[1] = phaseFields[e.index]
+		lines[2] = fieldValue(p, e.index)
+		adj1 = " EDIT  "
+	case editNumber:
+		lines[0] = e.recipe.Phases[e.phase].Name
+		lines[1] = phaseFields[e.field]
+		switch {
+		case isTimeField(e.field):
+			lines[2] = e.withCursor(2, ":")
+		case e.field == fieldStrokes:
+			lines[2] = e.withCursor(-1, "")
+		case e.field == fieldDwell || e.field == fieldMinDwell:
+			lines[2] = e.withCursor(-1, "") + " ms"
+		case e.field == fieldSpeedMm || e.field == fieldMinSpeedMm:
+			lines[2] = e.withCursor(len(e.buffer)-1, ".") + " mm/s"
+		case e.field == fieldTravelMm || e.field == fieldMinTravelMm:
+			lines[2] = e.withCursor(len(e.buffer)-1, ".") + " mm"
+		case e.field == fieldAccelerationMm:
+			lines[2] = e.withCursor(len(e.buffer)-1, ".") + " mm/s2"
+		default:
+			lines[2] = e.withCursor(-1, "") + " %"
+		}
+		adj1, adj2 = "  UP   ", " DONE  "
+	case editText:
+		lines[0] = "Phase name"
+		if e.renaming {
+			lines[0] = "Recipe name"
+		}
+		lines[1] = strings.TrimSpace(string(e.buffer))
+		lines[2] = e.withCursor(-1, "")
+		adj1, adj2 = " NEXT  ", " DONE  "
+	case editChoice:
+		lines[0] = e.recipe.Phases[e.phase].Name
+		lines[1] = phaseFields[e.field]
+		lines[2] = e.choices[e.choice]
+		adj1, adj2 = " NEXT  ", " DONE  "
+	case editConfirm:
+		lines[0] = e.question
+		lines[1] = e.recipe.Name
+		if e.confirmBack == editPhase {
+			lines[1] = e.recipe.Phases[e.phase].Name
+		}
+		adj1, adj2 = "  YES  ", "  NO   "
+	}
+
+	if e.message != "" {
+		lines[2] = e.message
+	}
+	for k := 0; k < 3; k++ {
+		if len(lines[k]) > 20 {
+			lines[k] = lines[k][:20]
+		}
+	}
+	lines[3] = FormatAdjustments(adj1, adj2)
+
+	e.linesMu.Lock()
+	e.lines = lines
+	e.linesMu.Unlock()
+}
+
+// The entry with brackets around the character under the cursor. A separator can be put in before position at.
+func (e *recipeEditor) withCursor(at int, separator string) string {
+	var b strings.Builder
+	for k, c := range e.buffer {
+		if k == at {
+			b.WriteString(separator)
+		}
+		if k == e.cursor {
+			b.WriteString("[" + string(c) + "]")
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func fieldValue(p Phase, field int) string {
+	switch field {
+	case fieldName:
+		return p.Name
+	case fieldTime:
+		if p.Seconds == 0 {
+			return "Off"
+		}
+		return formatMinSec(p.Seconds)
+	case fieldStrokes:
+		return formatStrokes(p.Strokes)
+	case fieldSpeed:
+		return strconv.Itoa(p.SpeedPercentage) + "%"
+	case fieldTravel:
+		return strconv.Itoa(p.TravelPercentage) + "%"
+	case fieldConstantSpeed:
+		return strconv.Itoa(p.ConstantSpeedPercentage) + "%"
+	case fieldDwell:
+		if p.DwellMilliseconds == 0 {
+			return "Off"
+		}
+		return strconv.Itoa(p.DwellMilliseconds) + " ms"
+	case fieldMinSpeed:
+		return strconv.Itoa(p.MinSpeedPercentage) + "%"
+	case fieldMinTravel:
+		return strconv.Itoa(p.MinTravelPercentage) + "%"
+	case fieldMinDwell:
+		return strconv.Itoa(p.MinDwellMilliseconds) + " ms"
+	case fieldSpeedMm:
+		return formatOptionalMm(p.SpeedMmPerSecond, " mm/s")
+	case fieldTravelMm:
+		return formatOptionalMm(p.TravelMm, " mm")
+	case fieldAccelerationMm:
+		return formatOptionalMm(p.AccelerationMmPerSecond2, " mm/s2")
+	case fieldMinSpeedMm:
+		return formatOptionalMm(p.MinSpeedMmPerSecond, " mm/s")
+	case fieldMinTravelMm:
+		return formatOptionalMm(p.MinTravelMm, " mm")
+	case fieldProfile:
+		if p.Profile == "" {
+			return string(ProfileTrapezoidal)
+		}
+		return string(p.Profile)
+	case fieldPattern:
+		return string(p.Pattern)
+	case fieldAgitate:
+		return formatMinSec(p.AgitateSeconds)
+	case fieldInterval:
+		if p.IntervalSeconds == 0 {
+			return "Once"
+		}
+		return formatMinSec(p.IntervalSeconds)
+	case fieldReleaseCoils:
+		return yesNo[boolIndex(p.ReleaseCoils)]
+	}
+	return ""
+}
+
+// A setting in mm, or Off if it is not set and the percentage is used
+func formatOptionalMm(mm float64, unit string) string {
+	if mm == 0 {
+		return "Off"
+	}
+	return formatMm(mm) + unit
+}
+
+// A setting in mm as digits for a number entry, the last one being tenths
+func formatTenths(mm float64, digits int) string {
+	return fmt.Sprintf("%0*d", digits, int(math.Round(mm*10)))
+}
+
+// Whether a field is entered as mm:ss
+func isTimeField(field int) bool {
+	return field == fieldTime || field == fieldAgitate || field == fieldInterval
+}
+
+func boolIndex(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatMinSec(seconds int) string {
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the public API. Use errors.Is to test for them, as they are usually wrapped in a StateError or
+// a RangeError with more detail.
+var (
+	ErrNotHomed     = errors.New("Axis is not homed")
+	ErrBusy         = errors.New("Machine is busy")
+	ErrEStopped     = errors.New("Emergency stop is active")
+	ErrFaulted      = errors.New("Machine is faulted")
+	ErrOutOfRange   = errors.New("Value is out of range")
+	ErrHomingFailed = errors.New("Homing failed")
+	ErrNotAgitating = errors.New("No agitation cycle is running")
+	ErrNotHeld      = errors.New("No feed hold is active")
+	ErrMoveAborted  = errors.New("Move aborted during feed hold")
+	ErrNoRecipe     = errors.New("No recipe is selected")
+	// A setting in mm was used without stepper.stepsPerMm in the configuration
+	ErrNotCalibrated = errors.New("Steps per mm is not calibrated")
+	// Matches every RecipeError
+	ErrInvalidRecipe = errors.New("Invalid recipe")
+)
+
+// A command that is not permitted in the current machine state, or motion that was stopped by a change of state
+type StateError struct {
+	// What was attempted
+	Op string
+	// State of the machine at the time
+	State MachineState
+	// Reason given for the last transition into that state
+	Reason string
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("%s not permitted in state %v (%s)", e.Op, e.State, e.Reason)
+}
+
+func (e *StateError) Unwrap() error {
+	switch e.State {
+	case StateUnhomed:
+		return ErrNotHomed
+	case StateHoming, StateMoving, StateAgitating:
+		return ErrBusy
+	case StateEStopped:
+		return ErrEStopped
+	case StateFaulted:
+		return ErrFaulted
+	}
+	return nil
+}
+
+// A parameter or a target position outside of its permitted range
+type RangeError struct {
+	Name  string
+	Value int
+	Min   int
+	Max   int
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("%s %d is out of range [%d, %d]", e.Name, e.Value, e.Min, e.Max)
+}
+
+func (e *RangeError) Unwrap() error {
+	return ErrOutOfRange
+}
+
+// A recipe that cannot be run. Phase is numbered from 1, or 0 if the problem is with the recipe as a whole.
+type RecipeError struct {
+	Recipe string
+	Phase  int
+	Err    error
+}
+
+func (e *RecipeError) Error() string {
+	if e.Phase == 0 {
+		return fmt.Sprintf("Recipe %q: %v", e.Recipe, e.Err)
+	}
+	return fmt.Sprintf("Recipe %q phase %d: %v", e.Recipe, e.Phase, e.Err)
+}
+
+func (e *RecipeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RecipeError) Is(target error) bool {
+	return target == ErrInvalidRecipe
+}
@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"context"
+	"fmt"
+)
+
+const (
+	// Commands that can wait for the executor. The machine state only lets one motion command run at a time, so the
+	// queue is there to bound the damage if that ever goes wrong rather than to hold a backlog.
+	motionQueueLength = 8
+)
+
+// The motion executor is the one goroutine that drives the stepper: moves, homing and the coil hold all run on it as
+// commands, one at a time and in the order they were queued. Each command comes with a future for its result.
+
+// Work for the executor
+type motionCommand struct {
+	run    func() (int, error)
+	future *motionFuture
+}
+
+// Result of a motion command, set once the executor has run it
+type motionFuture struct {
+	// Closed when the result is set
+	done chan struct{}
+	// Closed when the executor has stopped
+	stopped <-chan struct{}
+	// Steps left when a feed hold brought a move to rest
+	remaining int
+	err       error
+}
+
+func (f *motionFuture) finish(remaining int, err error) {
+	f.remaining = remaining
+	f.err = err
+	close(f.done)
+}
+
+// Wait for the command to finish. A command still queued when the executor stopped fails with ErrEStopped.
+func (f *motionFuture) wait() (int, error) {
+	select {
+	case <-f.done:
+	case <-f.stopped:
+		// The command may have finished just before the executor stopped
+		select {
+		case <-f.done:
+		default:
+			return 0, ErrEStopped
+		}
+	}
+	return f.remaining, f.err
+}
+
+// Run commands until Close()
+func (pg *PlateGenie) runExecutor() {
+	defer close(pg.executorDone)
+	for {
+		select {
+		case cmd := <-pg.motionCommands:
+			cmd.future.finish(cmd.run())
+		case <-pg.executorQuit:
+			for {
+				select {
+				case cmd := <-pg.motionCommands:
+					cmd.future.finish(0, ErrEStopped)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Queue a command for the executor, waiting for room in the queue if it is full
+func (pg *PlateGenie) submit(ctx context.Context, run func() (int, error)) *motionFuture {
+	f := &motionFuture{done: make(chan struct{}), stopped: pg.executorDone}
+	select {
+	case pg.motionCommands <- motionCommand{run, f}:
+	case <-ctx.Done():
+		f.finish(0, ctx.Err())
+	case <-pg.executorDone:
+		f.finish(0, ErrEStopped)
+	}
+	return f
+}
+
+// Check a timeline, play it on the executor and wait for it to finish. Returns the steps left if a feed hold brought
+// the move to rest.
+func (pg *PlateGenie) execute(ctx context.Context, t Timeline) (int, error) {
+	if err := t.Check(pg.stepper.GetPulseDuration()); err != nil {
+		return 0, err
+	}
+	return pg.submit(ctx, func() (int, error) {
+		return pg.play(ctx, t)
+	}).wait()
+}
+
+// Energize or de-energize the coils on the executor, so that it never happens part way through a move
+func (pg *PlateGenie) setCoils(enabled bool) {
+	pg.submit(context.Background(), func() (int, error) {
+		if enabled {
+			pg.stepper.EnableHold()
+		} else {
+			pg.stepper.DisableHold()
+		}
+		return 0, nil
+	}).wait()
+}
+
+// Plan and play a move. After a feed hold the remaining steps are planned again as a new move once the hold is
+// resumed. The caller is responsible for putting the machine into a motion state first. Cancelling the context brings
+// the carriage to rest along the ramp and returns the context error.
+func (pg *PlateGenie) moveTimeline(ctx context.Context, numStepsSigned int,
+	plan func(numStepsSigned int) (Timeline, error)) error {
+
+	for {
+		t, err := plan(numStepsSigned)
+		if err != nil {
+			return err
+		}
+		remaining, err := pg.execute(ctx, t)
+		if err != nil || remaining == 0 {
+			return err
+		}
+
+		if err := pg.waitForRelease(ctx); err != nil {
+			return err
+		}
+		numStepsSigned = remaining
+		if !t.Forward {
+			numStepsSigned = -remaining
+		}
+	}
+}
+
+// Step through a timeline, keeping to its times. Cancelling the context brings the move to rest the same way as a
+// feed hold and then returns the context error, so the carriage is never stopped dead at speed. An emergency stop or
+// a fault still stops it on the next step.
+func (pg *PlateGenie) play(ctx context.Context, t Timeline) (int, error) {
+	sched := newStepScheduler()
+	defer pg.recordTiming(sched)
+
+	for k, at := range t.Steps {
+		sched.waitUntil(at)
+		if err := pg.state.checkMotion(); err != nil {
+			return 0, err
+		}
+		if k < t.Decel {
+			if err := ctx.Err(); err != nil {
+				_, rampErr := pg.rampDown("Move cancelled", t, k)
+				if rampErr != nil {
+					return 0, rampErr
+				}
+				return 0, err
+			}
+			if pg.hold.isRequested() {
+				return pg.rampDown("Feed hold", t, k)
+			}
+		}
+		pg.step(t.Forward)
+	}
+	sched.finish(t.Duration)
+
+	// Cancelled while already slowing down at the end of the move, which is let finish
+	return 0, ctx.Err()
+}
+
+// Bring a move to rest from step k along the stop planned by the timeline. Returns the steps left once at rest. If the
+// move finishes while slowing down for a feed hold the hold stays requested for the next move.
+func (pg *PlateGenie) rampDown(reason string, t Timeline, k int) (int, error) {
+	remaining := len(t.Steps) - k
+	fmt.Println(reason, "with", remaining, "steps remaining")
+
+	stop := t.stopFrom(k)
+
+	sched := newStepScheduler()
+	defer pg.recordTiming(sched)
+
+	for _, at := range stop.Steps {
+		sched.waitUntil(at)
+		if err := pg.state.checkMotion(); err != nil {
+			return 0, err
+		}
+		pg.step(t.Forward)
+		remaining--
+	}
+	sched.finish(stop.Duration)
+
+	return remaining, nil
+}
@@ -0,0 +1,136 @@
+package plateGenie
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startExecutor() *PlateGenie {
+	pg := &PlateGenie{
+		motionCommands: make(chan motionCommand, motionQueueLength),
+		executorQuit:   make(chan struct{}),
+		executorDone:   make(chan struct{}),
+	}
+	go pg.runExecutor()
+	return pg
+}
+
+func stopExecutor(pg *PlateGenie) {
+	close(pg.executorQuit)
+	<-pg.executorDone
+}
+
+func TestExecutorOrder(t *testing.T) {
+	pg := startExecutor()
+	defer stopExecutor(pg)
+
+	// Commands never overlap, and commands queued from one goroutine run in the order they were queued
+	var mu sync.Mutex
+	running := 0
+	ran := make([][]int, 4)
+	var wg sync.WaitGroup
+	for g := range ran {
+		g := g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < 20; k++ {
+				k := k
+				pg.submit(context.Background(), func() (int, error) {
+					mu.Lock()
+					running++
+					if running > 1 {
+						t.Error("Two commands are running at once")
+					}
+					ran[g] = append(ran[g], k)
+					mu.Unlock()
+					time.Sleep(100 * time.Microsecond)
+					mu.Lock()
+					running--
+					mu.Unlock()
+					return k, nil
+				}).wait()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for g := range ran {
+		for k, got := range ran[g] {
+			if got != k {
+				t.Fatalf("Goroutine %d ran its commands in the order %v", g, ran[g])
+			}
+		}
+	}
+
+	if remaining, err := pg.submit(context.Background(), func() (int, error) {
+		return 7, ErrHomingFailed
+	}).wait(); remaining != 7 || !errors.Is(err, ErrHomingFailed) {
+		t.Errorf("Future returned %d, %v", remaining, err)
+	}
+}
+
+func TestExecutorQueueFull(t *testing.T) {
+	pg := startExecutor()
+	defer stopExecutor(pg)
+
+	// Hold up the executor and fill the queue behind it
+	release := make(chan struct{})
+	blocked := pg.submit(context.Background(), func() (int, error) {
+		<-release
+		return 0, nil
+	})
+	var queued []*motionFuture
+	for len(queued) < motionQueueLength {
+		queued = append(queued, pg.submit(context.Background(), func() (int, error) { return 0, nil }))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pg.submit(ctx, func() (int, error) { return 0, nil }).wait(); !errors.Is(err,
+		context.DeadlineExceeded) {
+		t.Errorf("Submit to a full queue: got %v, want context.DeadlineExceeded", err)
+	}
+
+	close(release)
+	if _, err := blocked.wait(); err != nil {
+		t.Error(err)
+	}
+	for _, f := range queued {
+		if _, err := f.wait(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestExecutorStop(t *testing.T) {
+	pg := startExecutor()
+
+	started, release := make(chan struct{}), make(chan struct{})
+	running := pg.submit(context.Background(), func() (int, error) {
+		close(started)
+		<-release
+		return 0, nil
+	})
+	<-started
+	queued := pg.submit(context.Background(), func() (int, error) { return 0, nil })
+
+	close(pg.executorQuit)
+	close(release)
+	<-pg.executorDone
+
+	if _, err := running.wait(); err != nil {
+		t.Errorf("Command running at the stop: %v", err)
+	}
+	// Either run before the executor saw the stop or failed, but never left waiting
+	if _, err := queued.wait(); err != nil && !errors.Is(err, ErrEStopped) {
+		t.Errorf("Command queued at the stop: got %v, want ErrEStopped", err)
+	}
+	if _, err := pg.submit(context.Background(), func() (int, error) { return 0, nil }).wait(); !errors.Is(err,
+		ErrEStopped) {
+		t.Errorf("Command submitted after the stop: got %v, want ErrEStopped", err)
+	}
+}
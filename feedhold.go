@@ -0,0 +1,153 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// How often a held move checks for an emergency stop or a fault while it waits
+	holdPollInterval = 20 * time.Millisecond
+)
+
+// Feed hold request shared between the API and the motion loops
+type feedHold struct {
+	mu sync.Mutex
+
+	// Set by FeedHold() and cleared by Resume(), Abort() or the end of the motion command
+	requested bool
+	// Receives true to abort or false to resume. Buffered so that the decision can be made before the carriage has
+	// come to rest.
+	decision chan bool
+}
+
+func (h *feedHold) request() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.requested {
+		return
+	}
+	h.requested = true
+	h.decision = make(chan bool, 1)
+}
+
+func (h *feedHold) isRequested() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requested
+}
+
+func (h *feedHold) release(abort bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.requested {
+		return ErrNotHeld
+	}
+	h.requested = false
+	h.decision <- abort
+	return nil
+}
+
+func (h *feedHold) clear() {
+	h.mu.Lock()
+	h.requested = false
+	h.mu.Unlock()
+}
+
+func (h *feedHold) wait() <-chan bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.decision
+}
+
+// Wait at rest during a feed hold until the move is resumed or aborted. An emergency stop, a fault or a cancelled
+// context also end the wait.
+func (pg *PlateGenie) waitForRelease(ctx context.Context) error {
+	decision := pg.hold.wait()
+
+	defer pg.menu.overlayScreen(&holdScreen{})()
+
+	ticker := time.NewTicker(holdPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case abort := <-decision:
+			if abort {
+				fmt.Println("Feed hold aborted")
+				return ErrMoveAborted
+			}
+			fmt.Println("Feed hold resumed")
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := pg.state.checkMotion(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Decelerate the current move to a stop along its ramp and hold there until Resume or Abort is called. During an
+// agitation cycle the hold applies to the current stroke. The red button and EStop remain a hard stop.
+func (pg *PlateGenie) FeedHold() error {
+	state, reason := pg.State()
+	if state != StateMoving && state != StateAgitating {
+		return &StateError{Op: "Feed hold", State: state, Reason: reason}
+	}
+	pg.hold.request()
+	return nil
+}
+
+// Continue the rest of a held move
+func (pg *PlateGenie) Resume() error {
+	return pg.hold.release(false)
+}
+
+// Abandon the rest of a held move. The held motion command returns ErrMoveAborted.
+func (pg *PlateGenie) Abort() error {
+	return pg.hold.release(true)
+}
+
+// Whether a feed hold has been requested and not yet resumed or aborted
+func (pg *PlateGenie) FeedHoldActive() bool {
+	return pg.hold.isRequested()
+}
+
+// Shown during a feed hold. The membrane keys do nothing until the hold ends, since only the buttons can end it.
+type holdScreen struct{}
+
+func (h *holdScreen) KeyPressed(key int) {}
+
+func (h *holdScreen) Paint(lcd Display) {
+	lcd.WriteLine("", 1)
+	lcd.WriteLineCentered("Feed hold", 2)
+	lcd.WriteLineCentered("Green to resume", 3)
+	lcd.WriteLine("", 4)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"time"
+)
+
+// The interfaces below are everything that PlateGenie needs from the hardware. The wrappers in the pi package adapt
+// the goLCD20x4, sysfsGPIO and softStepper libraries. Anything else that satisfies the interfaces (a
+// simulator or a fake in a test) can be passed in instead.
+
+// A 20x4 character display. Lines are numbered 1 through 4.
+type Display interface {
+	ClearDisplay()
+	WriteLine(s string, line int)
+	WriteLineCentered(s string, line int)
+}
+
+// A GPIO input such as a membrane key, a push button or a limit switch
+type InputPin interface {
+	// GPIO number used to match events from an InterruptSource to the pin
+	GPIONum() int
+	// Current logic level, 0 or 1
+	Read() (int, error)
+	// "rising", "falling" or "both"
+	SetTriggerEdge(edge string)
+	// Start reporting edges on the interrupt stream. One event is sent right away.
+	AddPinInterrupt()
+	ReleasePin()
+}
+
+// An edge detected on an InputPin
+type Interrupt struct {
+	GPIONum int
+}
+
+// A single stream of edge events for every pin with an interrupt added
+type InterruptSource interface {
+	GetInterruptStream() <-chan Interrupt
+}
+
+// A stepper motor driver
+type StepperDriver interface {
+	StepForward()
+	StepBackward()
+	// Time taken by one step at the maximum speed of the motor
+	GetPulseDuration() time.Duration
+	// Keep the coils energized while stopped
+	EnableHold()
+	// De-energize the coils while stopped
+	DisableHold()
+}
@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Number of runs kept in memory
+	historyLength = 100
+
+	// Results of a run that did not end on an error
+	RunComplete = "Complete"
+	RunStopped  = "Stopped"
+)
+
+// One agitation cycle
+type RunRecord struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Empty when agitating with the settings
+	Recipe string `json:"recipe,omitempty"`
+	// Seed of the random phases, for RunRecipeWithSeed. 0 if the recipe has none.
+	Seed    int64 `json:"seed,omitempty"`
+	Strokes int   `json:"strokes"`
+	// RunComplete, RunStopped or the error that ended the run
+	Result string `json:"result"`
+}
+
+// The most recent runs, oldest first
+func (pg *PlateGenie) History() []RunRecord {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	return append([]RunRecord(nil), pg.history...)
+}
+
+func (pg *PlateGenie) addRunRecord(record RunRecord) {
+	fmt.Printf("Run ended: %s after %d strokes\n", record.Result, record.Strokes)
+
+	pg.mu.Lock()
+	pg.history = append(pg.history, record)
+	if len(pg.history) > historyLength {
+		pg.history = append([]RunRecord(nil), pg.history[len(pg.history)-historyLength:]...)
+	}
+	pg.mu.Unlock()
+
+	if pg.config.HistoryFile == "" {
+		return
+	}
+	if err := appendRunRecord(pg.config.HistoryFile, record); err != nil {
+		fmt.Println("Could not save the run history:", err)
+	}
+}
+
+// Add a run to the end of a history file as one line of JSON
+func appendRunRecord(path string, record RunRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
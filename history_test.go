@@ -0,0 +1,44 @@
+package plateGenie
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunHistory(t *testing.T) {
+	pg := &PlateGenie{config: DefaultConfig()}
+	pg.config.HistoryFile = filepath.Join(t.TempDir(), "log", "history.jsonl")
+
+	for k := 0; k < historyLength+5; k++ {
+		pg.addRunRecord(RunRecord{Strokes: k, Result: RunComplete})
+	}
+
+	// Only the most recent runs are kept in memory
+	h := pg.History()
+	if len(h) != historyLength || h[0].Strokes != 5 || h[len(h)-1].Strokes != historyLength+4 {
+		t.Errorf("Kept %d runs from %d to %d strokes", len(h), h[0].Strokes, h[len(h)-1].Strokes)
+	}
+
+	// and every run in the file
+	f, err := os.Open(pg.config.HistoryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		var record RunRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Strokes != lines {
+			t.Fatalf("Line %d has %d strokes", lines+1, record.Strokes)
+		}
+	}
+	if lines != historyLength+5 {
+		t.Errorf("%d runs in the file, want %d", lines, historyLength+5)
+	}
+}
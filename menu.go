@@ -1,46 +1,183 @@
 package plateGenie
 
 import (
-	"github.com/the-sibyl/goLCD20x4"
+	"sync"
 	"time"
 )
 
+// Arrow characters in the standard HD44780 character ROM
+const (
+	leftArrow  = "\x7f"
+	rightArrow = "\x7e"
+)
+
 type Menu struct {
-	lcd             *goLCD20x4.LCD20x4
+	lcd             Display
 	firstMenuItem   *MenuItem
 	lastMenuItem    *MenuItem
 	currentMenuItem *MenuItem
+	// Closed when the menu is no longer being serviced
+	done chan struct{}
+	// Protects currentMenuItem, screen and the values of the menu items, which can be updated from other goroutines
+	mu sync.Mutex
+	// Screen showing in place of the menu items, if any
+	screen Screen
+	// Debounce time for the membrane keys
+	debounceTime time.Duration
 }
 
-func CreateMenu(lcd *goLCD20x4.LCD20x4) *Menu {
+func CreateMenu(lcd Display) *Menu {
 	var m Menu
 	m.lcd = lcd
+	m.done = make(chan struct{})
+	m.debounceTime = time.Microsecond * defaultDebounceTime
 	return &m
 }
 
+// Stop delivering soft key presses. Presses that are waiting on an action are dropped.
+func (m *Menu) stop() {
+	close(m.done)
+}
+
 func (m *Menu) Button1Pressed() {
+	if m.screenKey(1) {
+		return
+	}
+	m.mu.Lock()
 	m.currentMenuItem = m.currentMenuItem.prev
-	m.Repaint()
-	time.Sleep(time.Microsecond * defaultDebounceTime)
+	m.repaintLocked()
+	m.mu.Unlock()
+	time.Sleep(m.debounceTime)
 }
 
 func (m *Menu) Button2Pressed() {
-	m.currentMenuItem.action <- 1
-	time.Sleep(time.Microsecond * defaultDebounceTime)
+	if m.screenKey(2) {
+		return
+	}
+	select {
+	case m.current().action <- 1:
+	case <-m.done:
+	}
+	time.Sleep(m.debounceTime)
 }
 
 func (m *Menu) Button3Pressed() {
-	m.currentMenuItem.action <- 2
-	time.Sleep(time.Microsecond * defaultDebounceTime)
+	if m.screenKey(3) {
+		return
+	}
+	select {
+	case m.current().action <- 2:
+	case <-m.done:
+	}
+	time.Sleep(m.debounceTime)
 }
 
 func (m *Menu) Button4Pressed() {
+	if m.screenKey(4) {
+		return
+	}
+	m.mu.Lock()
 	m.currentMenuItem = m.currentMenuItem.next
+	m.repaintLocked()
+	m.mu.Unlock()
+	time.Sleep(m.debounceTime)
+}
+
+// A full screen that takes the keys over from the menu items until it is closed, e.g. the recipe editor
+type Screen interface {
+	// Keys are numbered 1 through 4 from the left
+	KeyPressed(key int)
+	// Write all four lines
+	Paint(lcd Display)
+}
+
+// Show a screen in place of the menu items
+func (m *Menu) OpenScreen(s Screen) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.screen = s
+	m.repaintLocked()
+}
+
+// Go back to the menu items
+func (m *Menu) CloseScreen() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.screen = nil
+	m.repaintLocked()
+}
+
+// Show a screen over the menu items or the open screen until restore is called, which puts back whatever was showing
+// before. Used for screens that come and go by themselves, like the feed hold.
+func (m *Menu) overlayScreen(s Screen) (restore func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	under := m.screen
+	m.screen = s
+	m.repaintLocked()
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// Leave alone a screen that was opened on top
+		if m.screen == s {
+			m.screen = under
+		}
+		m.repaintLocked()
+	}
+}
+
+// Pass a key press to the open screen. Returns false if there is none.
+func (m *Menu) screenKey(key int) bool {
+	m.mu.Lock()
+	s := m.screen
+	m.mu.Unlock()
+	if s == nil {
+		return false
+	}
+	s.KeyPressed(key)
 	m.Repaint()
-	time.Sleep(time.Microsecond * defaultDebounceTime)
+	time.Sleep(m.debounceTime)
+	return true
+}
+
+func (m *Menu) current() *MenuItem {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.currentMenuItem
+}
+
+// Change the values line of a menu item. The screen is only repainted if the item is showing.
+func (m *Menu) SetValues(mi *MenuItem, values string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mi.Values = values
+	if mi == m.currentMenuItem && m.screen == nil {
+		m.repaintLocked()
+	}
+}
+
+// Change the units and values lines of a menu item. The screen is only repainted if the item is showing.
+func (m *Menu) SetText(mi *MenuItem, units string, values string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mi.Units = units
+	mi.Values = values
+	if mi == m.currentMenuItem && m.screen == nil {
+		m.repaintLocked()
+	}
 }
 
 func (m *Menu) Repaint() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.repaintLocked()
+}
+
+func (m *Menu) repaintLocked() {
+	if m.screen != nil {
+		m.screen.Paint(m.lcd)
+		return
+	}
 	m.lcd.WriteLineCentered(m.currentMenuItem.Name, 1)
 	m.lcd.WriteLineCentered(m.currentMenuItem.Units, 2)
 	m.lcd.WriteLineCentered(m.currentMenuItem.Values, 3)
@@ -116,7 +253,12 @@ func (mi *MenuItem) AddAction() (action <-chan int) {
 
 // Helper for the last line which has the adjustment text and previous and next screen arrows
 func (mi *MenuItem) FormatAdjustmentsString() {
-	sc := goLCD20x4.GetSpecialCharacters()
+	mi.Adjustments = FormatAdjustments(mi.adj1, mi.adj2)
+}
 
-	mi.Adjustments = sc.LeftArrow + " " + mi.adj1 + "  " + mi.adj2 + " " + sc.RightArrow
+// Last line of a screen: the two soft key labels, padded or cut to seven characters, between the arrows
+func FormatAdjustments(adj1 string, adj2 string) string {
+	adj1 += "       "
+	adj2 += "       "
+	return leftArrow + " " + adj1[0:7] + "  " + adj2[0:7] + " " + rightArrow
 }
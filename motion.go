@@ -24,159 +24,135 @@ WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package plateGenie
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	//	"math"
+	"math"
 	"time"
-
-	"github.com/the-sibyl/softStepper"
 )
 
-func (pg *PlateGenie) move(s *softStepper.Stepper, numStepsSigned int, speedPercentage int) error {
-	if pg.motionFlag {
-		return errors.New("Axis is already in motion")
-	}
-	if speedPercentage <= 0 || speedPercentage > 100 {
-		return errors.New("Invalid speed percentage value")
-	}
+// Velocity profile of a move
+type Profile string
 
-	// Slow down the movement based on the maximum speed of the motor
-	slowDown := pg.stepper.GetPulseDuration() * time.Duration((100 / speedPercentage - 1))
+const (
+	// Ramp up at a constant acceleration, run at constant speed and ramp down again
+	ProfileTrapezoidal Profile = "trapezoidal"
+	// Position follows half a cosine wave, so the velocity rises and falls smoothly without any corners
+	ProfileSinusoidal Profile = "sinusoidal"
+	// Limit the jerk as well as the acceleration, so that the acceleration ramps up and down instead of jumping
+	ProfileSCurve Profile = "scurve"
+)
 
-	if numStepsSigned < 0 {
-		for k := 0; k < -numStepsSigned; k++ {
-			if pg.eStopFlag {
-				return errors.New("Motion stopped due to emergency stop signal")
-			}
-			s.StepBackward()
-			time.Sleep(slowDown)
-			pg.position--
-		}
-	} else if numStepsSigned > 0 {
-		for k := 0; k < numStepsSigned; k++ {
-			if pg.eStopFlag {
-				return errors.New("Motion stopped due to emergency stop signal")
-			}
-			s.StepForward()
-			time.Sleep(slowDown)
-			pg.position++
-		}
-	}
+// Every profile, in the order offered by the recipe editor
+var profiles = []Profile{ProfileTrapezoidal, ProfileSinusoidal, ProfileSCurve}
 
-	return nil
+// Move with the profile, speed and acceleration in the settings, in mm or in percentages. The caller is responsible
+// for putting the machine into a motion state first. A feed hold decelerates along the ramp and waits for the move to
+// be resumed or aborted.
+func (pg *PlateGenie) moveProfile(ctx context.Context, numStepsSigned int, s Settings) error {
+	return pg.moveTimeline(ctx, numStepsSigned, func(numStepsSigned int) (Timeline, error) {
+		return pg.planMove(numStepsSigned, s)
+	})
 }
 
-// Move with a trapezoidal acceleration profile
-// numSteps: total number of steps to move
-// speedPercentage: percentage of max stepper speed to move
-// constantSpeedPercentage: percentage of time spent at constant speed
-func (pg *PlateGenie) moveTrapezoidal(numStepsSigned int, speedPercentage int, constantSpeedPercentage int) error {
-	if pg.motionFlag {
-		return errors.New("Axis is already in motion")
-	}
+// Positioning move with the speed and acceleration in the settings. Always trapezoidal, since the profile is only for
+// agitation strokes.
+func (pg *PlateGenie) moveWithSettings(ctx context.Context, numStepsSigned int, s Settings) error {
+	s.Profile = ProfileTrapezoidal
+	return pg.moveProfile(ctx, numStepsSigned, s)
+}
 
-	if speedPercentage < 1 || speedPercentage > 100 {
-		return errors.New("Invalid speed percentage parameter")
-	} else if constantSpeedPercentage < 1 || constantSpeedPercentage > 99 {
-		return errors.New("Invalid constant speed percentage parameter")
+// Sleep after each step of a sinusoidal move. The move takes pi/2 times as long as it would at the peak speed. Step k
+// is centred on the time that the cosine reaches k+0.5 steps.
+func sinusoidalSleepTimes(numSteps int, peakStepTime time.Duration, pulseDuration time.Duration) []time.Duration {
+	duration := math.Pi / 2 * float64(numSteps) * float64(peakStepTime)
+	at := func(position float64) float64 {
+		return duration / math.Pi * math.Acos(1-2*position/float64(numSteps))
 	}
 
-	numSteps := 0
-	forwardDirection := true
-	if numStepsSigned < 0 {
-		numSteps = -numStepsSigned
-		forwardDirection = false
-	} else if numStepsSigned > 0 {
-		numSteps = numStepsSigned
-	} else {
-		// Do nothing as no motion was requested
-		return nil
+	stepTimes := make([]float64, numSteps)
+	for k := range stepTimes {
+		stepTimes[k] = at(float64(k) + 0.5)
 	}
+	return sleepTimesBetween(stepTimes, duration, pulseDuration)
+}
 
-	// Pulse duration from the stepper itself
-	pulseDuration := pg.stepper.GetPulseDuration()
-	// Delay added to slow down the stepper by the speedPeercentage parameter
-	constantSpeedDelta := pulseDuration * time.Duration(100/float32(speedPercentage)-1)
-	// Amount of total time taken per step at constant speed: stepper time AND speedPercentage slow-down time
-	// are both included
-	constantSpeedDelay := pulseDuration + constantSpeedDelta
-
-	// I derived this equation on paper. The assumption that I made is that the average velocity of the trapezoidal
-	// ramps is half the constant velocity.
-
-	numStepsAccelDecel := int(float32(numSteps) / (2/(100/float32(constantSpeedPercentage)-1) + 1))
-	fmt.Println(numStepsAccelDecel)
-	numStepsAccel := numStepsAccelDecel / 2
-	numStepsDecel := numStepsAccelDecel - numStepsAccel
-	numStepsConstantSpeed := numSteps - numStepsAccel - numStepsDecel
-
-	fmt.Println(numStepsAccel, numStepsDecel, numStepsConstantSpeed)
-
-	// Actual acceleration time
-	accelTime := time.Duration(numStepsAccel) * 2 * constantSpeedDelay
-	// Mininum acceleration time based on the stepper speed
-	minAccelTime := time.Duration(numStepsAccel) * pulseDuration
-	// Amount of sleep time difference between two acceleration steps (accumulate)
-	accelDelta := (accelTime - minAccelTime) / time.Duration(numStepsAccel*numStepsAccel)
-	// Start value for the loop
-	currentAccelSleepTime := constantSpeedDelta + accelDelta*time.Duration(numStepsAccel)
-
-	for k := 0; k < numStepsAccel; k++ {
-		if pg.eStopFlag {
-			return errors.New("Motion stopped due to emergency stop signal")
+// Sleep after each step, given the time of every step from the start of the move and the length of the move in
+// nanoseconds. The step itself takes the pulse duration.
+func sleepTimesBetween(stepTimes []float64, duration float64, pulseDuration time.Duration) []time.Duration {
+	sleepTimes := make([]time.Duration, len(stepTimes))
+	for k := range stepTimes {
+		next := duration
+		if k < len(stepTimes)-1 {
+			next = stepTimes[k+1]
 		}
-		if forwardDirection {
-			pg.stepper.StepForward()
-			pg.position++
-		} else {
-			pg.stepper.StepBackward()
-			pg.position--
+		sleepTimes[k] = time.Duration(next-stepTimes[k]) - pulseDuration
+		if sleepTimes[k] < 0 {
+			sleepTimes[k] = 0
 		}
-		time.Sleep(currentAccelSleepTime)
-		currentAccelSleepTime -= accelDelta
 	}
+	return sleepTimes
+}
 
-	for k := 0; k < numStepsConstantSpeed; k++ {
-		if pg.eStopFlag {
-			return errors.New("Motion stopped due to emergency stop signal")
-		}
-		if forwardDirection {
-			pg.stepper.StepForward()
-			pg.position++
-		} else {
-			pg.stepper.StepBackward()
-			pg.position--
-		}
-		time.Sleep(constantSpeedDelta)
+// Checked before every homing step. A cancelled context stops the motion without an emergency stop. Because the
+// position is updated on every step it stays accurate.
+func (pg *PlateGenie) checkStep(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return pg.state.checkMotion()
+}
+
+// Take one step and keep track of the position
+func (pg *PlateGenie) step(forward bool) {
+	if forward {
+		pg.stepper.StepForward()
+		pg.addPosition(1)
+	} else {
+		pg.stepper.StepBackward()
+		pg.addPosition(-1)
 	}
+}
+
+func (pg *PlateGenie) addPosition(steps int) {
+	pg.mu.Lock()
+	pg.position += steps
+	pg.mu.Unlock()
+}
 
-	// Copy the same values from the acceleration calculations
-	decelDelta := accelDelta
-	// Start value for the loop
-	currentDecelSleepTime := constantSpeedDelta
+// Run a homing operation on the executor and update the machine state with the result
+func (pg *PlateGenie) runHoming(ctx context.Context, reason string, homing func(ctx context.Context) error,
+	next MachineState, nextReason string) error {
 
-	for k := 0; k < numStepsDecel; k++ {
-		if pg.eStopFlag {
-			return errors.New("Motion stopped due to emergency stop signal")
-		}
-		if forwardDirection {
-			pg.stepper.StepForward()
-			pg.position++
-		} else {
-			pg.stepper.StepBackward()
-			pg.position--
-		}
-		time.Sleep(currentDecelSleepTime)
-		currentDecelSleepTime += decelDelta
+	if err := pg.state.transition(StateHoming, reason); err != nil {
+		return err
 	}
 
+	_, err := pg.submit(ctx, func() (int, error) {
+		return 0, homing(ctx)
+	}).wait()
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// The carriage has moved without the position being tracked
+		pg.state.transitionFrom(StateHoming, StateUnhomed, "Homing cancelled")
+		return err
+	} else if err != nil {
+		// Leaves an emergency stop alone
+		pg.state.transitionFrom(StateHoming, StateFaulted, err.Error())
+		return err
+	}
+
+	pg.state.transitionFrom(StateHoming, next, nextReason)
 	return nil
 }
 
-func (pg *PlateGenie) homeBoth() error {
-	if pg.motionFlag {
-		return errors.New("Axis is already in motion")
-	}
+func (pg *PlateGenie) homeBoth(ctx context.Context) error {
+	return pg.runHoming(ctx, "Homing both axes", pg.homeBothSteps, StateIdle, "Homing complete")
+}
+
+func (pg *PlateGenie) homeBothSteps(ctx context.Context) error {
+	maxHomingSteps := pg.config.Homing.MaxSteps
+	backoffSteps := pg.config.Homing.BackoffSteps
+	homingStepDelay := pg.config.homingStepDelay()
 
 	leftStatus, _ := pg.gpioLeftLimit.Read()
 	rightStatus, _ := pg.gpioRightLimit.Read()
@@ -187,7 +163,11 @@ func (pg *PlateGenie) homeBoth() error {
 	// The carriage is touching the left limit switch and needs to be backed off a bit for the first measurement
 	if leftStatus == 1 && rightStatus == 0 {
 		for k := 0; k < backoffSteps; k++ {
+			if err := pg.checkStep(ctx); err != nil {
+				return err
+			}
 			pg.stepper.StepForward()
+			time.Sleep(homingStepDelay)
 			rightStatus, _ = pg.gpioRightLimit.Read()
 			// This case should only happen if backoffSteps is unnecesarily large or the carriage
 			// separation is huge
@@ -201,25 +181,25 @@ func (pg *PlateGenie) homeBoth() error {
 
 	if leftStatus == 0 {
 		for k := 0; k < maxHomingSteps; k++ {
-			if pg.eStopFlag {
-				return errors.New("Motion stopped because of E-Stop")
+			if err := pg.checkStep(ctx); err != nil {
+				return err
 			}
 			pg.stepper.StepBackward()
-			time.Sleep(time.Microsecond * homingStepDelay)
+			time.Sleep(homingStepDelay)
 			leftStatus, _ = pg.gpioLeftLimit.Read()
 			if leftStatus == 1 {
 				break
 			}
 			if k == maxHomingSteps-1 {
-				return errors.New("Maximum number of steps exceeded on first left movement")
+				return fmt.Errorf("%w: Maximum number of steps exceeded on first left movement", ErrHomingFailed)
 			}
 		}
 		for k := 0; k < maxHomingSteps; k++ {
-			if pg.eStopFlag {
-				return errors.New("Motion stopped because of E-Stop")
+			if err := pg.checkStep(ctx); err != nil {
+				return err
 			}
 			pg.stepper.StepForward()
-			time.Sleep(time.Microsecond * homingStepDelay)
+			time.Sleep(homingStepDelay)
 			leftStatus, _ = pg.gpioLeftLimit.Read()
 			rightStatus, _ = pg.gpioRightLimit.Read()
 			if leftStatus == 0 && rightStatus == 0 {
@@ -229,61 +209,65 @@ func (pg *PlateGenie) homeBoth() error {
 				break
 			}
 			if k == maxHomingSteps-1 {
-				return errors.New("Maximum number of steps exceeded on left movement")
+				return fmt.Errorf("%w: Maximum number of steps exceeded on left movement", ErrHomingFailed)
 			}
 		}
 
 		for k := 0; k < homingStepCount/2; k++ {
-			if pg.eStopFlag {
-				return errors.New("Motion stopped because of E-Stop")
+			if err := pg.checkStep(ctx); err != nil {
+				return err
 			}
 			pg.stepper.StepBackward()
-			time.Sleep(time.Microsecond * homingStepDelay)
+			time.Sleep(homingStepDelay)
 			leftStatus, _ = pg.gpioLeftLimit.Read()
 			if leftStatus == 1 {
 				break
 			}
 			if k == maxHomingSteps-1 {
-				return errors.New("Maximum number of steps exceeded on second left movement")
+				return fmt.Errorf("%w: Maximum number of steps exceeded on second left movement", ErrHomingFailed)
 			}
 		}
 	} else {
-		return errors.New(`Homing malfunction. Try increasing the number of backoff steps or beginning the 
-			homing operation closer to the center.`)
+		return fmt.Errorf("%w: Try increasing the number of backoff steps or beginning the homing operation "+
+			"closer to the center.", ErrHomingFailed)
 	}
 
 	// Pad the left and right sides with a backoffSteps quantity of steps. Moving to position 0 will place the
 	// carriage near the left switch. Moving to position pg.homingStepCount will move the carriage near the right
 	// switch.
-	pg.homingStepCount = homingStepCount - 2 * backoffSteps
+	pg.mu.Lock()
+	pg.homingStepCount = homingStepCount - 2*backoffSteps
 	pg.position = pg.homingStepCount / 2
-	pg.homedFlag = true
+	pg.mu.Unlock()
 
 	return nil
 }
 
-func (pg *PlateGenie) homeLeft() error {
-	if pg.motionFlag {
-		return errors.New("Axis is already in motion")
-	}
+// Find the left switch and back off from it. This unhomes the axis.
+func (pg *PlateGenie) homeLeft(ctx context.Context) error {
+	return pg.runHoming(ctx, "Homing left", pg.homeLeftSteps, StateUnhomed, "Left switch found")
+}
 
-	pg.homedFlag = false
+func (pg *PlateGenie) homeLeftSteps(ctx context.Context) error {
+	maxHomingSteps := pg.config.Homing.MaxSteps
+	backoffSteps := pg.config.Homing.BackoffSteps
+	homingStepDelay := pg.config.homingStepDelay()
 
 	leftStatus, _ := pg.gpioLeftLimit.Read()
 
 	if leftStatus == 0 {
 		for k := 0; k < maxHomingSteps; k++ {
-			if pg.eStopFlag {
-				return errors.New("Motion stopped because of E-Stop")
+			if err := pg.checkStep(ctx); err != nil {
+				return err
 			}
 			pg.stepper.StepBackward()
-			time.Sleep(time.Microsecond * homingStepDelay)
+			time.Sleep(homingStepDelay)
 			leftStatus, _ = pg.gpioLeftLimit.Read()
 			if leftStatus == 1 {
 				break
 			}
 			if k == maxHomingSteps-1 {
-				return errors.New("Maximum number of steps exceeded on left homing movement")
+				return fmt.Errorf("%w: Maximum number of steps exceeded on left homing movement", ErrHomingFailed)
 			}
 		}
 	}
@@ -291,35 +275,41 @@ func (pg *PlateGenie) homeLeft() error {
 	// Do this open-loop. backoffSteps should be on the order of the amount of steps required to clear the
 	// limit switch.
 	for k := 0; k < backoffSteps; k++ {
+		if err := pg.checkStep(ctx); err != nil {
+			return err
+		}
 		pg.stepper.StepForward()
-		time.Sleep(time.Microsecond * homingStepDelay)
+		time.Sleep(homingStepDelay)
 	}
 
 	return nil
 }
 
-func (pg *PlateGenie) homeRight() error {
-	if pg.motionFlag {
-		return errors.New("Axis is already in motion")
-	}
+// Find the right switch and back off from it. This unhomes the axis.
+func (pg *PlateGenie) homeRight(ctx context.Context) error {
+	return pg.runHoming(ctx, "Homing right", pg.homeRightSteps, StateUnhomed, "Right switch found")
+}
 
-	pg.homedFlag = false
+func (pg *PlateGenie) homeRightSteps(ctx context.Context) error {
+	maxHomingSteps := pg.config.Homing.MaxSteps
+	backoffSteps := pg.config.Homing.BackoffSteps
+	homingStepDelay := pg.config.homingStepDelay()
 
 	rightStatus, _ := pg.gpioRightLimit.Read()
 
 	if rightStatus == 0 {
 		for k := 0; k < maxHomingSteps; k++ {
-			if pg.eStopFlag {
-				return errors.New("Motion stopped because of E-Stop")
+			if err := pg.checkStep(ctx); err != nil {
+				return err
 			}
 			pg.stepper.StepForward()
-			time.Sleep(time.Microsecond * homingStepDelay)
+			time.Sleep(homingStepDelay)
 			rightStatus, _ = pg.gpioRightLimit.Read()
 			if rightStatus == 1 {
 				break
 			}
 			if k == maxHomingSteps-1 {
-				return errors.New("Maximum number of steps exceeded on right homing movement")
+				return fmt.Errorf("%w: Maximum number of steps exceeded on right homing movement", ErrHomingFailed)
 			}
 		}
 	}
@@ -327,8 +317,11 @@ func (pg *PlateGenie) homeRight() error {
 	// Do this open-loop. backoffSteps should be on the order of the amount of steps required to clear the
 	// limit switch.
 	for k := 0; k < backoffSteps; k++ {
+		if err := pg.checkStep(ctx); err != nil {
+			return err
+		}
 		pg.stepper.StepBackward()
-		time.Sleep(time.Microsecond * homingStepDelay)
+		time.Sleep(homingStepDelay)
 	}
 
 	return nil
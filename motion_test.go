@@ -0,0 +1,41 @@
+package plateGenie
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSinusoidalSleepTimes(t *testing.T) {
+	const numSteps = 1000
+	peak := 200 * time.Microsecond
+	sleeps := sinusoidalSleepTimes(numSteps, peak, testPulse)
+	if len(sleeps) != numSteps {
+		t.Fatalf("%d sleeps for %d steps", len(sleeps), numSteps)
+	}
+
+	// pi/2 times as long as the whole move at the peak speed, less the wait before the first step, which is at half a
+	// step along the cosine
+	var total time.Duration
+	for _, sleep := range sleeps {
+		total += sleep + testPulse
+	}
+	duration := math.Pi / 2 * numSteps * float64(peak)
+	want := time.Duration(duration - duration/math.Pi*math.Acos(1-1.0/numSteps))
+	if d := total - want; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("Move takes %v, want %v", total, want)
+	}
+
+	// Speeds up to the peak in the middle and slows down the same way
+	for k := 0; k < numSteps/2-1; k++ {
+		if sleeps[k+1] > sleeps[k] {
+			t.Fatalf("Step %d takes longer than step %d while speeding up", k+1, k)
+		}
+		if d := sleeps[k] - sleeps[numSteps-2-k]; d < -time.Microsecond || d > time.Microsecond {
+			t.Fatalf("Step %d takes %v and step %d takes %v", k, sleeps[k], numSteps-2-k, sleeps[numSteps-2-k])
+		}
+	}
+	if middle := sleeps[numSteps/2] + testPulse; middle < peak*99/100 || middle > peak*101/100 {
+		t.Errorf("Middle step takes %v, want %v", middle, peak)
+	}
+}
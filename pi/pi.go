@@ -0,0 +1,142 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+// Wrappers that adapt the Raspberry Pi drivers to the interfaces in plateGenie's hardware.go. Kept out of the core
+// package so that it, and the simulator, build without the Pi libraries.
+package pi
+
+import (
+	"time"
+
+	"github.com/the-sibyl/goLCD20x4"
+	"github.com/the-sibyl/plateGenie"
+	"github.com/the-sibyl/softStepper"
+	"github.com/the-sibyl/sysfsGPIO"
+)
+
+type lcdDisplay struct {
+	lcd *goLCD20x4.LCD20x4
+}
+
+// Set up the LCD and wrap it as a Display
+func NewLCDDisplay(lcd *goLCD20x4.LCD20x4) plateGenie.Display {
+	lcd.FunctionSet(1, 1, 0)
+	lcd.DisplayOnOffControl(1, 0, 0)
+	lcd.EntryModeSet(1, 0)
+
+	return &lcdDisplay{lcd: lcd}
+}
+
+func (d *lcdDisplay) ClearDisplay() {
+	d.lcd.ClearDisplay()
+}
+
+func (d *lcdDisplay) WriteLine(s string, line int) {
+	d.lcd.WriteLine(s, line)
+}
+
+func (d *lcdDisplay) WriteLineCentered(s string, line int) {
+	d.lcd.WriteLineCentered(s, line)
+}
+
+type sysfsPin struct {
+	pin *sysfsGPIO.IOPin
+}
+
+// Wrap a sysfsGPIO pin as an InputPin. The pin should already be initialized as an input.
+func NewSysfsPin(pin *sysfsGPIO.IOPin) plateGenie.InputPin {
+	return &sysfsPin{pin: pin}
+}
+
+func (p *sysfsPin) GPIONum() int {
+	return p.pin.GPIONum
+}
+
+func (p *sysfsPin) Read() (int, error) {
+	v, err := p.pin.Read()
+	return int(v), err
+}
+
+func (p *sysfsPin) SetTriggerEdge(edge string) {
+	p.pin.SetTriggerEdge(edge)
+}
+
+func (p *sysfsPin) AddPinInterrupt() {
+	p.pin.AddPinInterrupt()
+}
+
+func (p *sysfsPin) ReleasePin() {
+	p.pin.ReleasePin()
+}
+
+type sysfsInterruptSource struct {
+	stream chan plateGenie.Interrupt
+}
+
+// Forward the sysfsGPIO interrupt stream as an InterruptSource. sysfsGPIO has one stream for the whole process, so
+// only one of these should be created.
+func NewSysfsInterruptSource() plateGenie.InterruptSource {
+	src := &sysfsInterruptSource{stream: make(chan plateGenie.Interrupt)}
+
+	go func() {
+		for {
+			s := <-sysfsGPIO.GetInterruptStream()
+			src.stream <- plateGenie.Interrupt{GPIONum: s.IOPin.GPIONum}
+		}
+	}()
+
+	return src
+}
+
+func (src *sysfsInterruptSource) GetInterruptStream() <-chan plateGenie.Interrupt {
+	return src.stream
+}
+
+type softStepperDriver struct {
+	stepper *softStepper.Stepper
+}
+
+// Wrap a softStepper motor as a StepperDriver
+func NewSoftStepperDriver(stepper *softStepper.Stepper) plateGenie.StepperDriver {
+	return &softStepperDriver{stepper: stepper}
+}
+
+func (d *softStepperDriver) StepForward() {
+	d.stepper.StepForward()
+}
+
+func (d *softStepperDriver) StepBackward() {
+	d.stepper.StepBackward()
+}
+
+func (d *softStepperDriver) GetPulseDuration() time.Duration {
+	return d.stepper.GetPulseDuration()
+}
+
+func (d *softStepperDriver) EnableHold() {
+	d.stepper.EnableHold()
+}
+
+func (d *softStepperDriver) DisableHold() {
+	d.stepper.DisableHold()
+}
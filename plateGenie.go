@@ -24,111 +24,224 @@ WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
 package plateGenie
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"strconv"
+	"sync"
 	"time"
-
-	"github.com/the-sibyl/goLCD20x4"
-	"github.com/the-sibyl/softStepper"
-	"github.com/the-sibyl/sysfsGPIO"
 )
 
 const (
 	// Stepper speed in microseconds
 	//stepperSpeed = 2000
-	// Maximum number of steps to be traversed for an axis move on a homing operation
-	maxHomingSteps = 10000
-	// Number of steps to back-off in a homing operation
-	backoffSteps = 50
-	// Delay to slow down the stepper for homing movements in addition to the built-in delay from the stepper Initialize()
-	homingStepDelay = 1000
+	// Default stepper pulse duration in microseconds
+	defaultStepperPulse = 1500
+	// Default maximum number of steps to be traversed for an axis move on a homing operation
+	defaultMaxHomingSteps = 10000
+	// Default number of steps to back-off in a homing operation
+	defaultBackoffSteps = 50
+	// Default delay in microseconds to slow down the stepper for homing movements in addition to the pulse duration
+	defaultHomingStepDelay = 1000
 	// Default speed percentage
 	defaultSpeedPercentage = 80
 	// Default percentage of time for the constant speed portion of a trapezoidal movement
 	defaultConstantSpeedPercentage = 70
 	// Default percentage of motion of the maximum distance to move the carriage
 	defaultTravelPercentage = 50
+	// Default length of an agitation cycle in seconds. 0 runs until End is pressed.
+	defaultAgitationSeconds = 0
+	// Longest agitation cycle that fits the mm:ss countdown
+	maxAgitationSeconds = 99*60 + 59
+	// Step for adjusting the agitation time from the menu
+	agitationSecondsStep = 15
+	// Default number of strokes in an agitation cycle. 0 for no limit.
+	defaultAgitationStrokes = 0
+	// Most strokes that fit the counter on the display
+	maxAgitationStrokes = 9999
+	// Step for adjusting the number of strokes from the menu
+	agitationStrokesStep = 5
+	// Default pause at each end of the stroke in milliseconds
+	defaultDwellMilliseconds = 0
+	maxDwellMilliseconds     = 5000
+	// Step for adjusting the dwell from the menu
+	dwellMillisecondsStep = 100
+	// Step for adjusting the speed percentage from the menu
+	speedPercentageStep = 1
+	// Presses of INC or DEC on the Speed item within fastStepWindow of each other that switch to steps
+	// fastStepMultiple times as big, so the fine steps do not make large changes tedious
+	fastStepPresses  = 5
+	fastStepWindow   = time.Second
+	fastStepMultiple = 10
+	// Steps for adjusting the settings in mm from the menu
+	speedMmPerSecondStep         = 0.5
+	travelMmStep                 = 5.0
+	accelerationMmPerSecond2Step = 50.0
+	// S-curve limits in steps per second squared and per second cubed
+	defaultSCurveAcceleration = 2000
+	defaultSCurveJerk         = 20000
 	// Default debounce time in microseconds for actions like keypresses
 	defaultDebounceTime = 160000
 )
 
 type PlateGenie struct {
-	lcd *goLCD20x4.LCD20x4
+	lcd Display
 
-	gpioMembrane1 *sysfsGPIO.IOPin
-	gpioMembrane2 *sysfsGPIO.IOPin
-	gpioMembrane3 *sysfsGPIO.IOPin
-	gpioMembrane4 *sysfsGPIO.IOPin
+	gpioMembrane1 InputPin
+	gpioMembrane2 InputPin
+	gpioMembrane3 InputPin
+	gpioMembrane4 InputPin
 
-	gpioRedButton   *sysfsGPIO.IOPin
-	gpioGreenButton *sysfsGPIO.IOPin
+	gpioRedButton   InputPin
+	gpioGreenButton InputPin
 
-	gpioLeftLimit  *sysfsGPIO.IOPin
-	gpioRightLimit *sysfsGPIO.IOPin
+	gpioLeftLimit  InputPin
+	gpioRightLimit InputPin
 
-	stepper *softStepper.Stepper
+	interrupts InterruptSource
 
-	// Emergency stop, used as a motion inhibit flag
-	eStopFlag bool
+	stepper StepperDriver
 
-	// Motion in progress flag
-	motionFlag bool
+	// Machine state. Motion is only permitted in the Homing, Moving and Agitating states.
+	state *stateMachine
 
-	// Axis homed flag
-	homedFlag bool
+	// Holds a token while a key press is being handled by the menu
+	menuBusy chan struct{}
 
-	// Number of steps counted on the axis between the limit switches
-	homingStepCount int
+	// Serializes saves of the settings file
+	settingsFileMu sync.Mutex
 
-	// Menu busy flag
-	menuBusyFlag bool
+	// Protects the fields below
+	mu sync.Mutex
 
-	// Limit watchdog flag: if enabled, motion stops and emergency stop is triggered
-	limitWatchdogFlag bool
+	// Number of steps counted on the axis between the limit switches
+	homingStepCount int
 
 	// Position starting with 0 on the motor side
 	position int
 
-	// Speed percentage of maximum for movements
-	speedPercentage int
+	// Speed, travel and trapezoidal motion settings
+	settings Settings
+
+	// Recipe run by the Agitation Cycle menu item. nil to agitate with the settings.
+	recipe *Recipe
+	// Recipes loaded from the recipe directory and the file that each one came from
+	recipes     []Recipe
+	recipePaths []string
+	// Name of the recipe showing on the Recipes menu item. Empty for none.
+	recipeBrowse string
+
+	// Coil hold chosen on the Stepper Hold menu item
+	coilHold bool
 
-	// Percentage of time at constant speed during a trapezoidal movement
-	constantSpeedPercentage int
+	// Feed hold requested through the API or the green button
+	hold feedHold
 
-	// Percentage of the maximum distance to move the carriage
-	travelPercentage int
+	// Closed to end the running agitation cycle, and closed by the cycle when it has finished
+	agitationStop chan struct{}
+	agitationDone chan struct{}
+	// Phase of the running cycle, if it is a recipe
+	agitationStatus AgitationStatus
+	// End of a timed agitation cycle or of the current phase. Zero if the cycle is not timed.
+	agitationDeadline time.Time
+	// Most recent agitation cycles, oldest first
+	history []RunRecord
+	// Step timing of the last move. See scheduler.go.
+	lastMoveTiming MoveTiming
+
+	// Pin mapping and machine constants. Not changed after Initialize().
+	config Config
 
 	// Debounce time for key press input
 	debounceTime time.Duration
+
+	menu *Menu
+	// Recipes menu item
+	recipeItem *MenuItem
+
+	// Long-running goroutines started by Run(): the menu action handlers and the interrupt handler
+	handlers []func(ctx context.Context)
+	// Wait group for the handlers
+	handlerWG sync.WaitGroup
+	// Wait group for the short-lived goroutines started by the handlers: motion and key presses
+	taskWG sync.WaitGroup
+
+	// Commands for the motion executor. See executor.go.
+	motionCommands chan motionCommand
+	// Closed by Close() to stop the executor, and by the executor once it has stopped
+	executorQuit chan struct{}
+	executorDone chan struct{}
+
+	runCalled bool
+	closed    bool
 }
 
 // List of items to pass:
 //
+// Configuration, or nil for DefaultConfig()
 // LCD
 // Membrane 1, 2, 3, 4
 // Red button, green button
 // Left limit, right limit
-func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOPin, gm3 *sysfsGPIO.IOPin,
-	gm4 *sysfsGPIO.IOPin, grb *sysfsGPIO.IOPin, ggb *sysfsGPIO.IOPin, gll *sysfsGPIO.IOPin, grl *sysfsGPIO.IOPin,
-	stepper *softStepper.Stepper) PlateGenie {
-
-	var pg PlateGenie
-
-	pg.eStopFlag = true
-	pg.motionFlag = false
-	pg.homedFlag = false
-	pg.menuBusyFlag = false
-	pg.limitWatchdogFlag = false
-	pg.speedPercentage = defaultSpeedPercentage
-	pg.constantSpeedPercentage = defaultConstantSpeedPercentage
-	pg.travelPercentage = defaultTravelPercentage
-	pg.debounceTime = defaultDebounceTime
+// Interrupt source for all of the pins above
+// Stepper
+//
+// The Raspberry Pi drivers can be wrapped with NewLCDDisplay, NewSysfsPin, NewSysfsInterruptSource and
+// NewSoftStepperDriver from the pi package.
+//
+// Initialize sets up the display and the pins and returns right away. Call Run() to start handling input, and
+// Close() when finished.
+func Initialize(cfg *Config, lcd Display, gm1 InputPin, gm2 InputPin, gm3 InputPin, gm4 InputPin, grb InputPin,
+	ggb InputPin, gll InputPin, grl InputPin, interrupts InterruptSource, stepper StepperDriver) (*PlateGenie, error) {
 
-	// Set up the display
-	lcd.FunctionSet(1, 1, 0)
-	lcd.DisplayOnOffControl(1, 0, 0)
-	lcd.EntryModeSet(1, 0)
+	if lcd == nil {
+		return nil, errors.New("No display provided")
+	}
+	for _, pin := range []InputPin{gm1, gm2, gm3, gm4, grb, ggb, gll, grl} {
+		if pin == nil {
+			return nil, errors.New("An input pin was not provided")
+		}
+	}
+	if interrupts == nil {
+		return nil, errors.New("No interrupt source provided")
+	}
+	if stepper == nil {
+		return nil, errors.New("No stepper provided")
+	}
+
+	config := DefaultConfig()
+	if cfg != nil {
+		config = *cfg
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	// The pins have to be the ones named in the configuration
+	wired := []int{config.Pins.Membrane[0], config.Pins.Membrane[1], config.Pins.Membrane[2], config.Pins.Membrane[3],
+		config.Pins.RedButton, config.Pins.GreenButton, config.Pins.LeftLimit, config.Pins.RightLimit}
+	for k, pin := range []InputPin{gm1, gm2, gm3, gm4, grb, ggb, gll, grl} {
+		if pin.GPIONum() != wired[k] {
+			return nil, fmt.Errorf("Input pin %d is GPIO %d but the configuration has GPIO %d", k+1, pin.GPIONum(),
+				wired[k])
+		}
+	}
+
+	pg := &PlateGenie{}
+
+	// Start with motion inhibited until the green button is pressed
+	pg.state = newStateMachine(StateEStopped, "Power on")
+	pg.menuBusy = make(chan struct{}, 1)
+	pg.config = config
+	// Needed by the menu items that show speeds in mm/s
+	pg.stepper = stepper
+	pg.settings = config.Defaults
+	if config.SettingsFile != "" {
+		pg.settings = loadSettings(config.SettingsFile, config.Defaults, config.Stepper.StepsPerMm)
+	}
+	pg.debounceTime = config.debounceTime()
 
+	// Set up the display
 	lcd.ClearDisplay()
 
 	lcd.WriteLineCentered("Welcome to", 2)
@@ -139,6 +252,8 @@ func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOP
 	time.Sleep(time.Millisecond * 700)
 
 	m := CreateMenu(lcd)
+	m.debounceTime = pg.debounceTime
+	pg.menu = m
 
 	// ---------------
 	// FIRST MENU ITEM
@@ -146,21 +261,20 @@ func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOP
 	mi1 := m.AddMenuItem("Home Both", "", "", "   GO  ", "  GO   ")
 	a1 := mi1.AddAction()
 	// Action handler
-	go func() {
-		homeBothFlag := false
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			<-a1
-			if !homeBothFlag {
-				homeBothFlag = true
-				go func() {
-					fmt.Println("Home both")
-					pg.limitWatchdogFlag = false
-					pg.homeBoth()
-					homeBothFlag = false
-				}()
+			if _, ok := waitAction(ctx, a1); !ok {
+				return
 			}
+			pg.spawn(func() {
+				fmt.Println("Home both")
+				if err := pg.Home(ctx); err != nil {
+					fmt.Println(err)
+					pg.showNotReady()
+				}
+			})
 		}
-	}()
+	})
 
 	// ----------------
 	// SECOND MENU ITEM
@@ -168,33 +282,32 @@ func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOP
 	mi2 := m.AddMenuItem("Home Single", "(This will unhome", "both axes.)", " Left  ", " Right ")
 	a2 := mi2.AddAction()
 	// Action handler
-	go func() {
-		homeSingleFlag := false
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			switch <-a2 {
+			key, ok := waitAction(ctx, a2)
+			if !ok {
+				return
+			}
+			switch key {
 			case 1:
-				if !homeSingleFlag {
-					homeSingleFlag = true
-					go func() {
-						fmt.Println("Home left")
-						pg.limitWatchdogFlag = false
-						pg.homeLeft()
-						homeSingleFlag = false
-					}()
-				}
+				pg.spawn(func() {
+					fmt.Println("Home left")
+					if err := pg.homeLeft(ctx); err != nil {
+						fmt.Println(err)
+						pg.showNotReady()
+					}
+				})
 			case 2:
-				if !homeSingleFlag {
-					homeSingleFlag = true
-					go func() {
-						fmt.Println("Home right")
-						pg.limitWatchdogFlag = false
-						pg.homeRight()
-						homeSingleFlag = false
-					}()
-				}
+				pg.spawn(func() {
+					fmt.Println("Home right")
+					if err := pg.homeRight(ctx); err != nil {
+						fmt.Println(err)
+						pg.showNotReady()
+					}
+				})
 			}
 		}
-	}()
+	})
 
 	// ---------------
 	// THIRD MENU ITEM
@@ -202,124 +315,79 @@ func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOP
 	mi3 := m.AddMenuItem("Move to Center", "", "", "   GO  ", "  GO   ")
 	a3 := mi3.AddAction()
 	// Action handler
-	go func() {
-		moveToCenterFlag := false
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			<-a3
-			if !moveToCenterFlag {
-				moveToCenterFlag = true
-				centerPosition := pg.homingStepCount / 2
-				fmt.Println("Current position:", pg.position)
-				fmt.Println("Center position:", centerPosition)
-				distToMove := centerPosition - pg.position
-				fmt.Println("Distance to move:", distToMove)
-				go func() {
-					fmt.Println("Move to center")
-					fmt.Println("pg.homedFlag:", pg.homedFlag)
-					if pg.homedFlag {
-						pg.limitWatchdogFlag = true
-						pg.moveTrapezoidal(distToMove, pg.speedPercentage, pg.constantSpeedPercentage)
-						pg.limitWatchdogFlag = false
-					} else {
-						lcd.ClearDisplay()
-						lcd.WriteLineCentered("Please home", 2)
-						lcd.WriteLineCentered("the device.", 3)
-						time.Sleep(time.Second)
-						m.Repaint()
-					}
-					moveToCenterFlag = false
-				}()
+			if _, ok := waitAction(ctx, a3); !ok {
+				return
 			}
+			pg.spawn(func() {
+				fmt.Println("Move to center")
+				if err := pg.MoveTo(ctx, pg.TravelSteps()/2); err != nil {
+					fmt.Println(err)
+					pg.showNotReady()
+				}
+			})
 		}
-	}()
+	})
 
 	// ----------------
 	// FOURTH MENU ITEM
 	// ----------------
-	mi4 := m.AddMenuItem("Speed", "(% Max Speed)", strconv.Itoa(pg.speedPercentage)+"%", "   INC ", " DEC   ")
+	speedUnits := "(% Max Speed)"
+	if pg.calibrated() {
+		speedUnits = "(mm/s)"
+	}
+	mi4 := m.AddMenuItem("Speed", speedUnits, pg.formatSpeed(pg.settings), "   INC ", " DEC   ")
 	a4 := mi4.AddAction()
 	// Action handler
-	go func() {
-		changeSpeedFlag := false
+	pg.addHandler(func(ctx context.Context) {
+		var repeat pressRepeat
 		for {
-			switch <-a4 {
+			key, ok := waitAction(ctx, a4)
+			if !ok {
+				return
+			}
+			switch key {
 			case 1:
-				if !changeSpeedFlag {
-					changeSpeedFlag = true
-					go func() {
-						fmt.Println("Increase max speed")
-						newSpeedPercentage := pg.speedPercentage + 10
-						if newSpeedPercentage <= 100 {
-							pg.speedPercentage = newSpeedPercentage
-						}
-						mi4.Values = strconv.Itoa(pg.speedPercentage) + "%"
-						m.Repaint()
-						time.Sleep(pg.debounceTime)
-						changeSpeedFlag = false
-					}()
-				}
+				fmt.Println("Increase max speed")
+				m.SetValues(mi4, pg.formatSpeed(pg.changeSpeed(true, repeat.press(true))))
+				time.Sleep(pg.debounceTime)
 			case 2:
-				if !changeSpeedFlag {
-					changeSpeedFlag = true
-					go func() {
-						fmt.Println("Decrease max speed")
-						newSpeedPercentage := pg.speedPercentage - 10
-						if newSpeedPercentage > 0 {
-							pg.speedPercentage = newSpeedPercentage
-						}
-						mi4.Values = strconv.Itoa(pg.speedPercentage) + "%"
-						m.Repaint()
-						time.Sleep(pg.debounceTime)
-						changeSpeedFlag = false
-					}()
-				}
+				fmt.Println("Decrease max speed")
+				m.SetValues(mi4, pg.formatSpeed(pg.changeSpeed(false, repeat.press(false))))
+				time.Sleep(pg.debounceTime)
 			}
 		}
-	}()
+	})
 
 	// ---------------
 	// FIFTH MENU ITEM
 	// ---------------
-	mi5 := m.AddMenuItem("Travel", "(% Max Distance)", strconv.Itoa(pg.travelPercentage)+"%", "   INC ", " DEC   ")
+	travelUnits := "(% Max Distance)"
+	if pg.calibrated() {
+		travelUnits = "(mm)"
+	}
+	mi5 := m.AddMenuItem("Travel", travelUnits, pg.formatTravel(pg.settings), "   INC ", " DEC   ")
 	a5 := mi5.AddAction()
 	// Action handler
-	go func() {
-		changeTravelFlag := false
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			switch <-a5 {
+			key, ok := waitAction(ctx, a5)
+			if !ok {
+				return
+			}
+			switch key {
 			case 1:
-				if !changeTravelFlag {
-					changeTravelFlag = true
-					go func() {
-						fmt.Println("Increase travel percentage")
-						newTravelPercentage := pg.travelPercentage + 10
-						if newTravelPercentage <= 100 {
-							pg.travelPercentage = newTravelPercentage
-						}
-						mi5.Values = strconv.Itoa(pg.travelPercentage) + "%"
-						m.Repaint()
-						time.Sleep(pg.debounceTime)
-						changeTravelFlag = false
-					}()
-				}
+				fmt.Println("Increase travel percentage")
+				m.SetValues(mi5, pg.formatTravel(pg.changeTravel(true)))
+				time.Sleep(pg.debounceTime)
 			case 2:
-				if !changeTravelFlag {
-					changeTravelFlag = true
-					go func() {
-						fmt.Println("Decrease travel percentage")
-						newTravelPercentage := pg.travelPercentage - 10
-						if newTravelPercentage > 0 {
-							pg.travelPercentage = newTravelPercentage
-						}
-						mi5.Values = strconv.Itoa(pg.travelPercentage) + "%"
-						m.Repaint()
-						time.Sleep(pg.debounceTime)
-						changeTravelFlag = false
-					}()
-				}
+				fmt.Println("Decrease travel percentage")
+				m.SetValues(mi5, pg.formatTravel(pg.changeTravel(false)))
+				time.Sleep(pg.debounceTime)
 			}
 		}
-	}()
+	})
 
 	// ---------------
 	// SIXTH MENU ITEM
@@ -327,18 +395,22 @@ func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOP
 	mi6 := m.AddMenuItem("Stepper Hold", "", "", "   ENA ", " DIS   ")
 	a6 := mi6.AddAction()
 	// Action handler
-	go func() {
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			switch <-a6 {
+			key, ok := waitAction(ctx, a6)
+			if !ok {
+				return
+			}
+			switch key {
 			case 1:
 				fmt.Println("Enable stepper hold")
-				pg.stepper.EnableHold()
+				pg.setCoilHold(true)
 			case 2:
 				fmt.Println("Disable stepper hold")
-				pg.stepper.DisableHold()
+				pg.setCoilHold(false)
 			}
 		}
-	}()
+	})
 
 	// -----------------
 	// SEVENTH MENU ITEM
@@ -346,82 +418,62 @@ func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOP
 	mi7 := m.AddMenuItem("Move to Extents", "(Closest positions", "to switches.)", " Left  ", " Right ")
 	a7 := mi7.AddAction()
 	// Action handler
-	go func() {
-		homeExtentsFlag := false
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			switch <-a7 {
+			key, ok := waitAction(ctx, a7)
+			if !ok {
+				return
+			}
+			switch key {
 			case 1:
-				if !homeExtentsFlag {
-					homeExtentsFlag = true
-					go func() {
-						fmt.Println("Left extent")
-						distToMove := -pg.position
-						pg.limitWatchdogFlag = true
-						pg.moveTrapezoidal(distToMove, pg.speedPercentage, pg.constantSpeedPercentage)
-						pg.limitWatchdogFlag = false
-						homeExtentsFlag = false
-					}()
-				}
+				pg.spawn(func() {
+					fmt.Println("Left extent")
+					if err := pg.MoveTo(ctx, 0); err != nil {
+						fmt.Println(err)
+						pg.showNotReady()
+					}
+				})
 			case 2:
-				if !homeExtentsFlag {
-					homeExtentsFlag = true
-					go func() {
-						fmt.Println("Right extent")
-						distToMove := pg.homingStepCount - pg.position
-						pg.limitWatchdogFlag = true
-						pg.moveTrapezoidal(distToMove, pg.speedPercentage, pg.constantSpeedPercentage)
-						pg.limitWatchdogFlag = false
-						homeExtentsFlag = false
-					}()
-				}
+				pg.spawn(func() {
+					fmt.Println("Right extent")
+					if err := pg.MoveTo(ctx, pg.TravelSteps()); err != nil {
+						fmt.Println(err)
+						pg.showNotReady()
+					}
+				})
 			}
 		}
-	}()
+	})
 
 	// ----------------
 	// EIGHTH MENU ITEM
 	// ----------------
-	mi8 := m.AddMenuItem("Trapezoidal Motion", "(% Time at CV)", strconv.Itoa(pg.constantSpeedPercentage)+"%",
-		"   INC ", " DEC   ")
+	// Acceleration in place of the time at constant speed on a calibrated rig. Off goes back to the percentage.
+	rampName, rampUnits := "Trapezoidal Motion", "(% Time at CV)"
+	if pg.calibrated() {
+		rampName, rampUnits = "Acceleration", "(mm/s2)"
+	}
+	mi8 := m.AddMenuItem(rampName, rampUnits, pg.formatRamp(pg.settings), "   INC ", " DEC   ")
 	a8 := mi8.AddAction()
 	// Action handler
-	go func() {
-		cspFlag := false
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			switch <-a8 {
+			key, ok := waitAction(ctx, a8)
+			if !ok {
+				return
+			}
+			switch key {
 			case 1:
-				if !cspFlag {
-					cspFlag = true
-					go func() {
-						fmt.Println("Increase percentage time at constant speed")
-						newCSPercentage := pg.constantSpeedPercentage + 10
-						if newCSPercentage <= 100 {
-							pg.constantSpeedPercentage = newCSPercentage
-						}
-						mi8.Values = strconv.Itoa(pg.constantSpeedPercentage) + "%"
-						m.Repaint()
-						time.Sleep(pg.debounceTime)
-						cspFlag = false
-					}()
-				}
+				fmt.Println("Increase percentage time at constant speed")
+				m.SetValues(mi8, pg.formatRamp(pg.changeRamp(true)))
+				time.Sleep(pg.debounceTime)
 			case 2:
-				if !cspFlag {
-					cspFlag = true
-					go func() {
-						fmt.Println("Decrease percentage time at constant speed")
-						newCSPercentage := pg.constantSpeedPercentage - 10
-						if newCSPercentage > 0 {
-							pg.constantSpeedPercentage = newCSPercentage
-						}
-						mi8.Values = strconv.Itoa(pg.constantSpeedPercentage) + "%"
-						m.Repaint()
-						time.Sleep(pg.debounceTime)
-						cspFlag = false
-					}()
-				}
+				fmt.Println("Decrease percentage time at constant speed")
+				m.SetValues(mi8, pg.formatRamp(pg.changeRamp(false)))
+				time.Sleep(pg.debounceTime)
 			}
 		}
-	}()
+	})
 
 	// ---------------
 	// NINTH MENU ITEM
@@ -429,70 +481,151 @@ func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOP
 	mi9 := m.AddMenuItem("Agitation Cycle", "", "", " Begin ", "  End  ")
 	a9 := mi9.AddAction()
 	// Action handler
-	go func() {
-		acFlag := false
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			switch <-a9 {
+			key, ok := waitAction(ctx, a9)
+			if !ok {
+				return
+			}
+			switch key {
 			case 1:
-				if !acFlag {
-					acFlag = true
-					if !pg.homedFlag {
-						lcd.ClearDisplay()
-						lcd.WriteLineCentered("Please home", 2)
-						lcd.WriteLineCentered("the device.", 3)
-						// Add debouncing functionality
-						select {
-						case <-a9:
-							time.Sleep(time.Second)
-						case <-time.After(time.Second):
-							break
-						}
-						m.Repaint()
-						acFlag = false
-						continue
-					}
-					go func() {
-						fmt.Println("Begin agitation")
-						pg.limitWatchdogFlag = true
-						moveDistance := pg.travelPercentage * pg.homingStepCount / 100
-						startMoveSteps := ((pg.homingStepCount - moveDistance) / 2) - pg.position
-						pg.moveTrapezoidal(startMoveSteps, pg.speedPercentage,
-							pg.constantSpeedPercentage)
-						for {
-							newMoveDistance := pg.travelPercentage * pg.homingStepCount / 100
-							if moveDistance != newMoveDistance {
-								moveDistance = newMoveDistance
-								startMoveSteps := ((pg.homingStepCount - moveDistance) / 2) - pg.position
-								pg.moveTrapezoidal(startMoveSteps, pg.speedPercentage,
-									pg.constantSpeedPercentage)
-							}
-							pg.moveTrapezoidal(moveDistance, pg.speedPercentage,
-								pg.constantSpeedPercentage)
-							if acFlag == false || pg.eStopFlag {
-								break
-							}
-							pg.moveTrapezoidal(-moveDistance, pg.speedPercentage,
-								pg.constantSpeedPercentage)
-							if acFlag == false || pg.eStopFlag {
-								break
-							}
-						}
-						pg.limitWatchdogFlag = false
-						acFlag = false
-					}()
+				var err error
+				if r := pg.SelectedRecipe(); r != nil {
+					fmt.Println("Begin recipe", r.Name)
+					err = pg.RunRecipe(ctx, *r)
+				} else {
+					fmt.Println("Begin agitation")
+					err = pg.StartAgitation(ctx)
 				}
-			case 2:
-				acFlag = false
-				if !acFlag {
-					acFlag = true
-					go func() {
-						fmt.Println("End agitation")
-						acFlag = false
-					}()
+				if err != nil {
+					fmt.Println(err)
+					pg.spawn(pg.showNotReady)
+				} else {
+					pg.spawn(func() { pg.showCountdown(ctx, mi9) })
 				}
+			case 2:
+				// Finishes the current stroke first
+				pg.spawn(func() {
+					fmt.Println("End agitation")
+					pg.StopAgitation(ctx)
+				})
 			}
 		}
-	}()
+	})
+
+	// ---------------
+	// TENTH MENU ITEM
+	// ---------------
+	mi10 := m.AddMenuItem("Agitation Time", "(mm:ss)", formatAgitationTime(pg.settings.AgitationSeconds),
+		"   INC ", " DEC   ")
+	a10 := mi10.AddAction()
+	// Action handler
+	pg.addHandler(func(ctx context.Context) {
+		for {
+			key, ok := waitAction(ctx, a10)
+			if !ok {
+				return
+			}
+			step := agitationSecondsStep
+			if key == 2 {
+				step = -agitationSecondsStep
+			}
+			fmt.Println("Change agitation time by", step, "seconds")
+			s, _ := pg.updateSettings(func(s *Settings) { s.AgitationSeconds += step })
+			m.SetValues(mi10, formatAgitationTime(s.AgitationSeconds))
+			time.Sleep(pg.debounceTime)
+		}
+	})
+
+	// ------------------
+	// ELEVENTH MENU ITEM
+	// ------------------
+	mi11 := m.AddMenuItem("Recipes", "", "", "  NEXT ", "SELECT ")
+	a11 := mi11.AddAction()
+	pg.recipeItem = mi11
+	if config.RecipeDir != "" {
+		sig := pg.loadRecipeDir()
+		pg.addHandler(func(ctx context.Context) {
+			pg.watchRecipeDir(ctx, sig)
+		})
+	}
+	pg.showRecipes()
+	// Action handler
+	pg.addHandler(func(ctx context.Context) {
+		for {
+			key, ok := waitAction(ctx, a11)
+			if !ok {
+				return
+			}
+			switch key {
+			case 1:
+				pg.browseNextRecipe()
+			case 2:
+				pg.selectBrowsedRecipe()
+			}
+		}
+	})
+
+	// -----------------
+	// TWELFTH MENU ITEM
+	// -----------------
+	mi12 := m.AddMenuItem("Recipe Editor", "", "", "  EDIT ", "  EDIT ")
+	a12 := mi12.AddAction()
+	// Action handler
+	pg.addHandler(func(ctx context.Context) {
+		for {
+			if _, ok := waitAction(ctx, a12); !ok {
+				return
+			}
+			pg.openRecipeEditor()
+		}
+	})
+
+	// --------------------
+	// THIRTEENTH MENU ITEM
+	// --------------------
+	mi13 := m.AddMenuItem("Agitation Strokes", "", formatStrokes(pg.settings.AgitationStrokes), "   INC ", " DEC   ")
+	a13 := mi13.AddAction()
+	// Action handler
+	pg.addHandler(func(ctx context.Context) {
+		for {
+			key, ok := waitAction(ctx, a13)
+			if !ok {
+				return
+			}
+			step := agitationStrokesStep
+			if key == 2 {
+				step = -agitationStrokesStep
+			}
+			fmt.Println("Change agitation strokes by", step)
+			s, _ := pg.updateSettings(func(s *Settings) { s.AgitationStrokes += step })
+			m.SetValues(mi13, formatStrokes(s.AgitationStrokes))
+			time.Sleep(pg.debounceTime)
+		}
+	})
+
+	// --------------------
+	// FOURTEENTH MENU ITEM
+	// --------------------
+	mi14 := m.AddMenuItem("Stroke Dwell", "(ms)", formatDwell(pg.settings.DwellMilliseconds), "   INC ", " DEC   ")
+	a14 := mi14.AddAction()
+	// Action handler
+	pg.addHandler(func(ctx context.Context) {
+		for {
+			key, ok := waitAction(ctx, a14)
+			if !ok {
+				return
+			}
+			step := dwellMillisecondsStep
+			if key == 2 {
+				step = -dwellMillisecondsStep
+			}
+			fmt.Println("Change stroke dwell by", step, "milliseconds")
+			s, _ := pg.updateSettings(func(s *Settings) { s.DwellMilliseconds += step })
+			m.SetValues(mi14, formatDwell(s.DwellMilliseconds))
+			time.Sleep(pg.debounceTime)
+		}
+	})
 
 	// Set up the membrane keypad GPIO here. Presume that the caller provides an input pin.
 	gm1.SetTriggerEdge("rising")
@@ -529,88 +662,417 @@ func Initialize(lcd *goLCD20x4.LCD20x4, gm1 *sysfsGPIO.IOPin, gm2 *sysfsGPIO.IOP
 	grl.AddPinInterrupt()
 	pg.gpioRightLimit = grl
 
+	pg.interrupts = interrupts
+
 	// Expend the events created with AddPinInterrupt()
 	for k := 0; k < 8; k++ {
-		fmt.Println("Expending", k, <-sysfsGPIO.GetInterruptStream())
+		fmt.Println("Expending", k, <-pg.interrupts.GetInterruptStream())
 	}
 
-	go func() {
+	pg.addHandler(func(ctx context.Context) {
 		for {
-			s := <-sysfsGPIO.GetInterruptStream()
-			switch s.IOPin.GPIONum {
+			var s Interrupt
+			select {
+			case <-ctx.Done():
+				return
+			case s = <-pg.interrupts.GetInterruptStream():
+			}
+			switch s.GPIONum {
 			// Button 1
-			case pg.gpioMembrane1.GPIONum:
+			case pg.gpioMembrane1.GPIONum():
 				fmt.Println("Button 1 pressed")
-				if !pg.menuBusyFlag {
-					pg.menuBusyFlag = true
-					go func() {
-						m.Button1Pressed()
-						pg.menuBusyFlag = false
-					}()
-				}
+				pg.pressKey(m.Button1Pressed)
 			// Button 2
-			case pg.gpioMembrane2.GPIONum:
-				if !pg.menuBusyFlag {
-					pg.menuBusyFlag = true
-					go func() {
-						m.Button2Pressed()
-						pg.menuBusyFlag = false
-					}()
-				}
+			case pg.gpioMembrane2.GPIONum():
+				pg.pressKey(m.Button2Pressed)
 			// Button 3
-			case pg.gpioMembrane3.GPIONum:
-				if !pg.menuBusyFlag {
-					pg.menuBusyFlag = true
-					go func() {
-						m.Button3Pressed()
-						pg.menuBusyFlag = false
-					}()
-				}
+			case pg.gpioMembrane3.GPIONum():
+				pg.pressKey(m.Button3Pressed)
 			// Button 4
-			case pg.gpioMembrane4.GPIONum:
-				if !pg.menuBusyFlag {
-					pg.menuBusyFlag = true
-					go func() {
-						m.Button4Pressed()
-						pg.menuBusyFlag = false
-					}()
-				}
-			case pg.gpioLeftLimit.GPIONum:
+			case pg.gpioMembrane4.GPIONum():
+				pg.pressKey(m.Button4Pressed)
+			// The limit switches are only expected to change during homing
+			case pg.gpioLeftLimit.GPIONum():
 				fmt.Println("Left limit hit")
-				if pg.limitWatchdogFlag {
-					pg.eStopFlag = true
-				}
-			case pg.gpioRightLimit.GPIONum:
+				pg.state.faultIf("Left limit switch hit during motion", StateMoving, StateAgitating)
+			case pg.gpioRightLimit.GPIONum():
 				fmt.Println("Right limit hit")
-				if pg.limitWatchdogFlag {
-					pg.eStopFlag = true
+				pg.state.faultIf("Right limit switch hit during motion", StateMoving, StateAgitating)
+			// The green button resets an emergency stop when stopped, and toggles a feed hold during motion
+			case pg.gpioGreenButton.GPIONum():
+				fmt.Println("Green button hit")
+				state, _ := pg.State()
+				var err error
+				if pg.FeedHoldActive() {
+					err = pg.Resume()
+				} else if state == StateMoving || state == StateAgitating {
+					err = pg.FeedHold()
+				} else {
+					err = pg.state.reset("Green button")
 				}
-			case pg.gpioGreenButton.GPIONum:
-				if pg.eStopFlag {
-					pg.motionFlag = false
+				if err != nil {
+					fmt.Println(err)
 				}
-				pg.eStopFlag = false
-				fmt.Println("Green button hit")
-			case pg.gpioRedButton.GPIONum:
-				pg.eStopFlag = true
-				pg.motionFlag = false
+			case pg.gpioRedButton.GPIONum():
 				fmt.Println("Red button hit")
+				pg.state.eStop("Red button")
 			}
 		}
+	})
+
+	// The executor is the one goroutine started here rather than by Run. It only runs commands that are submitted to
+	// it, and Close always stops it, so nothing is left running whether or not Run is called.
+	pg.motionCommands = make(chan motionCommand, motionQueueLength)
+	pg.executorQuit = make(chan struct{})
+	pg.executorDone = make(chan struct{})
+	go pg.runExecutor()
+
+	return pg, nil
+}
+
+// Handle the keypad, the buttons and the limit switches until the context is cancelled. Motion started from the menu
+// uses the same context, so it stops when the context is cancelled and Run waits for it. Run can only be called once.
+func (pg *PlateGenie) Run(ctx context.Context) error {
+	if pg.runCalled {
+		return errors.New("Run has already been called")
+	}
+	pg.runCalled = true
+
+	for _, h := range pg.handlers {
+		h := h
+		pg.handlerWG.Add(1)
+		go func() {
+			defer pg.handlerWG.Done()
+			h(ctx)
+		}()
+	}
+
+	<-ctx.Done()
+
+	// Release any key press that is waiting on a handler that has already returned
+	pg.menu.stop()
+	pg.handlerWG.Wait()
+	pg.taskWG.Wait()
+
+	return ctx.Err()
+}
+
+// Stop motion, de-energize the coils and release the pins. Call Close after Run has returned, or on its own if Run was
+// never called.
+func (pg *PlateGenie) Close() error {
+	if pg.closed {
+		return nil
+	}
+	pg.closed = true
+
+	pg.state.eStop("Closed")
+	pg.taskWG.Wait()
+
+	pg.mu.Lock()
+	agitationDone := pg.agitationDone
+	pg.mu.Unlock()
+	if agitationDone != nil {
+		<-agitationDone
+	}
+
+	close(pg.executorQuit)
+	<-pg.executorDone
+
+	// The executor has stopped, so nothing else is using the stepper
+	pg.stepper.DisableHold()
+
+	for _, pin := range []InputPin{pg.gpioMembrane1, pg.gpioMembrane2, pg.gpioMembrane3, pg.gpioMembrane4,
+		pg.gpioRedButton, pg.gpioGreenButton, pg.gpioLeftLimit, pg.gpioRightLimit} {
+		pin.ReleasePin()
+	}
+
+	pg.lcd.ClearDisplay()
+
+	return nil
+}
+
+// Register a long-running goroutine to be started by Run()
+func (pg *PlateGenie) addHandler(h func(ctx context.Context)) {
+	pg.handlers = append(pg.handlers, h)
+}
+
+// Start a short-lived goroutine that Run() and Close() wait for
+func (pg *PlateGenie) spawn(f func()) {
+	pg.taskWG.Add(1)
+	go func() {
+		defer pg.taskWG.Done()
+		f()
 	}()
+}
 
-	pg.stepper = stepper
+// Handle a key press unless the menu is still busy with the previous one
+func (pg *PlateGenie) pressKey(buttonPressed func()) {
+	select {
+	case pg.menuBusy <- struct{}{}:
+	default:
+		return
+	}
+	pg.spawn(func() {
+		buttonPressed()
+		<-pg.menuBusy
+	})
+}
+
+// Return to Idle at the end of a move or an agitation cycle. An emergency stop or a fault during the motion is left
+// in place.
+func (pg *PlateGenie) finishMotion(from MachineState, err error) {
+	if err != nil {
+		fmt.Println(err)
+	}
+	pg.hold.clear()
+	pg.state.transitionFrom(from, StateIdle, "Motion complete")
+}
+
+// Energize or de-energize the coils while stopped, and remember the choice
+func (pg *PlateGenie) setCoilHold(enabled bool) {
+	pg.mu.Lock()
+	pg.coilHold = enabled
+	pg.mu.Unlock()
+	pg.restoreCoilHold()
+}
+
+// Put the coils back to the hold chosen on the menu after releasing them
+func (pg *PlateGenie) restoreCoilHold() {
+	pg.mu.Lock()
+	enabled := pg.coilHold
+	pg.mu.Unlock()
+	pg.setCoils(enabled)
+}
+
+// Speed as shown on the menu, in mm/s on a calibrated rig
+func (pg *PlateGenie) formatSpeed(s Settings) string {
+	if pg.calibrated() {
+		return formatMm(pg.speedMmPerSecond(s)) + " mm/s"
+	}
+	return strconv.Itoa(s.SpeedPercentage) + "%"
+}
+
+// Presses of a key in the same direction in quick succession
+type pressRepeat struct {
+	last  time.Time
+	up    bool
+	count int
+}
+
+// Count a press and return the multiple of the fine step that it should make
+func (r *pressRepeat) press(up bool) int {
+	now := time.Now()
+	if up == r.up && now.Sub(r.last) < fastStepWindow {
+		r.count++
+	} else {
+		r.count = 1
+	}
+	r.last = now
+	r.up = up
+	if r.count > fastStepPresses {
+		return fastStepMultiple
+	}
+	return 1
+}
+
+// Step the speed up or down from the menu by a multiple of the fine step, stopping at the ends of the range. Returns
+// the settings in effect afterwards.
+func (pg *PlateGenie) changeSpeed(up bool, multiple int) Settings {
+	if !pg.calibrated() {
+		step := speedPercentageStep * multiple
+		if !up {
+			step = -step
+		}
+		s, _ := pg.updateSettings(func(s *Settings) {
+			s.SpeedPercentage += step
+			if s.SpeedPercentage < 1 {
+				s.SpeedPercentage = 1
+			} else if s.SpeedPercentage > 100 {
+				s.SpeedPercentage = 100
+			}
+		})
+		return s
+	}
+
+	step := speedMmPerSecondStep * float64(multiple)
+	if !up {
+		step = -step
+	}
+	maxSpeed := pg.maxStepsPerSecond() / pg.config.Stepper.StepsPerMm
+	// Never slower than 1% of the maximum, which is the slowest that a move will run
+	minSpeed := math.Max(speedMmPerSecondStep, maxSpeed/100)
+	speed := math.Min(math.Max(stepMm(pg.speedMmPerSecond(pg.Settings()), step), minSpeed), maxSpeed)
+	s, _ := pg.updateSettings(func(s *Settings) { s.SpeedMmPerSecond = speed })
+	return s
+}
 
-	//	pg.homeBoth()
+// Stroke length as shown on the menu, in mm on a calibrated rig
+func (pg *PlateGenie) formatTravel(s Settings) string {
+	if pg.calibrated() {
+		return formatMm(pg.travelMm(s)) + " mm"
+	}
+	return strconv.Itoa(s.TravelPercentage) + "%"
+}
+
+// Step the stroke length up or down from the menu. Returns the settings in effect afterwards.
+func (pg *PlateGenie) changeTravel(up bool) Settings {
+	if !pg.calibrated() {
+		step := 10
+		if !up {
+			step = -step
+		}
+		s, _ := pg.updateSettings(func(s *Settings) { s.TravelPercentage += step })
+		return s
+	}
+
+	step := travelMmStep
+	if !up {
+		step = -step
+	}
+	travel := math.Max(stepMm(pg.travelMm(pg.Settings()), step), travelMmStep)
+	// The rail length is only known once homed
+	if rail := pg.stepsToMm(pg.TravelSteps()); rail > 0 && travel > rail {
+		travel = math.Floor(rail/travelMmStep) * travelMmStep
+	}
+	s, _ := pg.updateSettings(func(s *Settings) { s.TravelMm = travel })
+	return s
+}
 
+// Ramps as shown on the menu: the acceleration on a calibrated rig and the time at constant speed otherwise
+func (pg *PlateGenie) formatRamp(s Settings) string {
+	if pg.calibrated() {
+		return formatOptionalMm(s.AccelerationMmPerSecond2, " mm/s2")
+	}
+	return strconv.Itoa(s.ConstantSpeedPercentage) + "%"
+}
+
+// Step the ramps up or down from the menu. Returns the settings in effect afterwards.
+func (pg *PlateGenie) changeRamp(up bool) Settings {
+	if !pg.calibrated() {
+		step := 10
+		if !up {
+			step = -step
+		}
+		s, _ := pg.updateSettings(func(s *Settings) { s.ConstantSpeedPercentage += step })
+		return s
+	}
+
+	step := accelerationMmPerSecond2Step
+	if !up {
+		step = -step
+	}
+	acceleration := math.Max(stepMm(pg.Settings().AccelerationMmPerSecond2, step), 0)
+	s, _ := pg.updateSettings(func(s *Settings) { s.AccelerationMmPerSecond2 = acceleration })
+	return s
+}
+
+// Agitation time as shown on the menu
+func formatAgitationTime(seconds int) string {
+	if seconds == 0 {
+		return "Until End"
+	}
+	return formatMinSec(seconds)
+}
+
+// Stroke limit as shown on the menu
+func formatStrokes(strokes int) string {
+	if strokes == 0 {
+		return "Off"
+	}
+	return strconv.Itoa(strokes)
+}
+
+// Dwell as shown on the menu
+func formatDwell(milliseconds int) string {
+	if milliseconds == 0 {
+		return "Off"
+	}
+	return strconv.Itoa(milliseconds)
+}
+
+// Show the phase and count down a timed agitation cycle on the values line of the menu item until the cycle has
+// finished
+func (pg *PlateGenie) showCountdown(ctx context.Context, mi *MenuItem) {
 	for {
-		time.Sleep(time.Second)
+		status, ok := pg.AgitationStatus()
+		if !ok {
+			pg.menu.SetValues(mi, "")
+			return
+		}
+		// Leave the feed hold screen alone. The menu is repainted when the hold ends.
+		if !pg.FeedHoldActive() {
+			pg.menu.SetValues(mi, formatAgitationStatus(status))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Millisecond * 200):
+		}
 	}
+}
 
-	return pg
+// Fit the phase, the stroke count and the time left on one line, e.g. "2/3 Stop 12/40 00:30"
+func formatAgitationStatus(status AgitationStatus) string {
+	remaining := strconv.Itoa(status.Strokes)
+	if status.StrokeLimit > 0 {
+		remaining += "/" + strconv.Itoa(status.StrokeLimit)
+	}
+	if status.Timed {
+		// Round up so that 00:00 is only shown once the time is up
+		seconds := int((status.Remaining + time.Second - 1) / time.Second)
+		remaining += " " + formatMinSec(seconds)
+	}
+	if status.PhaseNumber == 0 {
+		return remaining
+	}
 
+	phase := fmt.Sprintf("%d/%d ", status.PhaseNumber, status.PhaseCount)
+	name := status.Phase
+	if status.Resting {
+		name = "Resting"
+	}
+	room := 20 - len(phase) - len(remaining) - 1
+	if room <= 0 {
+		// Big counters leave no room for the name
+		return phase + remaining
+	}
+	if len(name) > room {
+		name = name[:room]
+	}
+	return phase + name + " " + remaining
 }
 
-func agitate() {
+// Tell the user why a command could not run, then go back to the menu. Nothing is shown if the machine is busy with
+// another command.
+func (pg *PlateGenie) showNotReady() {
+	state, _ := pg.State()
+	switch state {
+	case StateUnhomed:
+		pg.lcd.ClearDisplay()
+		pg.lcd.WriteLineCentered("Please home", 2)
+		pg.lcd.WriteLineCentered("the device.", 3)
+	case StateEStopped:
+		pg.lcd.ClearDisplay()
+		pg.lcd.WriteLineCentered("Emergency stop.", 2)
+		pg.lcd.WriteLineCentered("Press green.", 3)
+	case StateFaulted:
+		pg.lcd.ClearDisplay()
+		pg.lcd.WriteLineCentered("Fault. Press green", 2)
+		pg.lcd.WriteLineCentered("and home again.", 3)
+	default:
+		return
+	}
+	time.Sleep(time.Second)
+	pg.menu.Repaint()
+}
 
+// Wait for a soft key on a menu item. Returns false if the context is cancelled first.
+func waitAction(ctx context.Context, action <-chan int) (int, bool) {
+	select {
+	case <-ctx.Done():
+		return 0, false
+	case key := <-action:
+		return key, true
+	}
 }
@@ -0,0 +1,57 @@
+package plateGenie
+
+import (
+	"testing"
+)
+
+func TestPressRepeat(t *testing.T) {
+	var r pressRepeat
+	for k := 1; k <= fastStepPresses; k++ {
+		if got := r.press(true); got != 1 {
+			t.Fatalf("Press %d stepped by %d, want 1", k, got)
+		}
+	}
+	if got := r.press(true); got != fastStepMultiple {
+		t.Errorf("Press %d stepped by %d, want %d", fastStepPresses+1, got, fastStepMultiple)
+	}
+	// Changing direction starts counting again
+	if got := r.press(false); got != 1 {
+		t.Errorf("Press in the other direction stepped by %d, want 1", got)
+	}
+}
+
+func TestChangeSpeed(t *testing.T) {
+	pg := newTestPlateGenie(0)
+	pg.settings = defaultSettings()
+	pg.settings.SpeedPercentage = 60
+	if s := pg.changeSpeed(true, 1); s.SpeedPercentage != 61 {
+		t.Errorf("Speed up 1%% from 60%%: got %d%%", s.SpeedPercentage)
+	}
+	if s := pg.changeSpeed(false, fastStepMultiple); s.SpeedPercentage != 51 {
+		t.Errorf("Speed down 10%% from 61%%: got %d%%", s.SpeedPercentage)
+	}
+	if s := pg.changeSpeed(false, 100); s.SpeedPercentage != 1 {
+		t.Errorf("Speed down past the bottom: got %d%%", s.SpeedPercentage)
+	}
+	if s := pg.changeSpeed(true, 200); s.SpeedPercentage != 100 {
+		t.Errorf("Speed up past the top: got %d%%", s.SpeedPercentage)
+	}
+
+	// 200 mm/s at most and 2 mm/s at least at 100 steps per mm
+	pg = newTestPlateGenie(100)
+	pg.settings = defaultSettings()
+	pg.settings.SpeedMmPerSecond = 100
+	if s := pg.changeSpeed(true, 1); s.SpeedMmPerSecond != 100.5 {
+		t.Errorf("Speed up from 100 mm/s: got %v", s.SpeedMmPerSecond)
+	}
+	// The fast steps land on multiples of 5 mm/s
+	if s := pg.changeSpeed(false, fastStepMultiple); s.SpeedMmPerSecond != 100 {
+		t.Errorf("Speed down 5 mm/s from 100.5 mm/s: got %v", s.SpeedMmPerSecond)
+	}
+	if s := pg.changeSpeed(false, 1000); s.SpeedMmPerSecond != 2 {
+		t.Errorf("Speed down past the bottom: got %v", s.SpeedMmPerSecond)
+	}
+	if s := pg.changeSpeed(true, 1000); s.SpeedMmPerSecond != 200 {
+		t.Errorf("Speed up past the top: got %v", s.SpeedMmPerSecond)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+)
+
+// A motion program is a list of segments that are queued and planned together, looking ahead to the next segment, so
+// the carriage only comes to rest where it has to reverse or dwell. Between segments in the same direction the speed
+// changes on the move, to the lower of the two speeds or less if there is not enough room to slow down for what
+// comes after.
+//
+// Programs are only run through RunProgram in the API. The menu and the agitation patterns in recipes do not use the
+// queue.
+
+// One part of a motion program
+type Segment struct {
+	// Steps to move. Positive steps move to the right. 0 for a dwell on its own.
+	Steps int `json:"steps"`
+	// Percentage of the maximum stepper speed. 0 for the speed in the settings.
+	SpeedPercentage int `json:"speedPercentage"`
+	// Pause at the end of the segment in milliseconds. The carriage comes to rest for it.
+	DwellMilliseconds int `json:"dwellMilliseconds"`
+}
+
+func (seg Segment) Validate() error {
+	if seg.SpeedPercentage < 0 || seg.SpeedPercentage > 100 {
+		return &RangeError{"Speed percentage", seg.SpeedPercentage, 0, 100}
+	}
+	if seg.DwellMilliseconds < 0 || seg.DwellMilliseconds > maxDwellMilliseconds {
+		return &RangeError{"Dwell milliseconds", seg.DwellMilliseconds, 0, maxDwellMilliseconds}
+	}
+	return nil
+}
+
+// A segment in steps and seconds, ready to be planned
+type queuedSegment struct {
+	steps int
+	// Cruise speed in steps per second
+	velocity float64
+	// Steps per second squared
+	acceleration float64
+}
+
+// Segments that run without stopping, all in the same direction, and the pause after them
+type motionRun struct {
+	forward  bool
+	segments []queuedSegment
+	dwell    time.Duration
+}
+
+// Runs waiting to be played, in order
+type motionQueue struct {
+	runs []motionRun
+}
+
+// Add a segment to the queue. It joins the last run if it carries on in the same direction without a dwell in
+// between.
+func (q *motionQueue) push(numStepsSigned int, velocity float64, acceleration float64, dwell time.Duration) {
+	forward, numSteps := direction(numStepsSigned)
+	last := len(q.runs) - 1
+	if numSteps > 0 {
+		seg := queuedSegment{numSteps, velocity, acceleration}
+		if last >= 0 && q.runs[last].dwell == 0 && (q.runs[last].forward == forward ||
+			len(q.runs[last].segments) == 0) {
+			q.runs[last].forward = forward
+			q.runs[last].segments = append(q.runs[last].segments, seg)
+		} else {
+			q.runs = append(q.runs, motionRun{forward: forward, segments: []queuedSegment{seg}})
+		}
+	} else if last < 0 {
+		q.runs = append(q.runs, motionRun{})
+	}
+	q.runs[len(q.runs)-1].dwell += dwell
+}
+
+// The segments covering the last numSteps steps of a run, for planning the rest of it after a feed hold
+func tailSegments(segments []queuedSegment, numSteps int) []queuedSegment {
+	var tail []queuedSegment
+	for k := len(segments) - 1; k >= 0 && numSteps > 0; k-- {
+		seg := segments[k]
+		if seg.steps > numSteps {
+			seg.steps = numSteps
+		}
+		numSteps -= seg.steps
+		tail = append([]queuedSegment{seg}, tail...)
+	}
+	return tail
+}
+
+// Plan a run as one move that starts and ends at rest. The speed where two segments meet is limited by both of
+// their speeds, then by a pass backwards from the end so that there is always room to slow down for the next
+// junction, and a pass forwards from the start so that every junction speed can be reached. Each segment then speeds
+// up from its entry speed, cruises and slows down to its exit speed at its own acceleration. A feed hold anywhere
+// before the slow-down at the end brakes from the speed the carriage is at, at the lowest acceleration of the segments.
+func blendTimeline(forward bool, segments []queuedSegment, pulseDuration time.Duration) Timeline {
+	// Fastest speed at the end of a segment entered at speed v
+	reachable := func(v float64, seg queuedSegment) float64 {
+		return math.Sqrt(v*v + 2*seg.acceleration*float64(seg.steps))
+	}
+
+	m := len(segments)
+	junctions := make([]float64, m+1)
+	for i := 1; i < m; i++ {
+		junctions[i] = math.Min(segments[i-1].velocity, segments[i].velocity)
+	}
+	for i := m - 1; i > 0; i-- {
+		junctions[i] = math.Min(junctions[i], reachable(junctions[i+1], segments[i]))
+	}
+	for i := 1; i < m; i++ {
+		junctions[i] = math.Min(junctions[i], reachable(junctions[i-1], segments[i-1]))
+	}
+
+	t := Timeline{Forward: forward}
+	// Start of the segment in seconds
+	var start float64
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second))
+	}
+	for i, seg := range segments {
+		u, w, a := junctions[i], junctions[i+1], seg.acceleration
+		peak := math.Min(seg.velocity, math.Sqrt((2*a*float64(seg.steps)+u*u+w*w)/2))
+		accelSteps := (peak*peak - u*u) / (2 * a)
+		cruiseSteps := float64(seg.steps) - accelSteps - (peak*peak-w*w)/(2*a)
+		if cruiseSteps < 0 {
+			cruiseSteps = 0
+		}
+
+		// Time to reach x steps into the segment
+		at := func(x float64) float64 {
+			if x < accelSteps {
+				return (math.Sqrt(u*u+2*a*x) - u) / a
+			}
+			accelTime := (peak - u) / a
+			if x < accelSteps+cruiseSteps {
+				return accelTime + (x-accelSteps)/peak
+			}
+			x -= accelSteps + cruiseSteps
+			return accelTime + cruiseSteps/peak + (peak-math.Sqrt(math.Max(peak*peak-2*a*x, 0)))/a
+		}
+
+		if i == 0 {
+			t.Ramp = int(accelSteps)
+			t.Braking = a
+		}
+		t.Braking = math.Min(t.Braking, a)
+		if i == m-1 {
+			t.Decel = len(t.Steps) + int(math.Ceil(accelSteps+cruiseSteps))
+			if t.Decel > len(t.Steps)+seg.steps {
+				t.Decel = len(t.Steps) + seg.steps
+			}
+		}
+		for k := 0; k < seg.steps; k++ {
+			t.Steps = append(t.Steps, seconds(start+at(float64(k))))
+		}
+		start += at(float64(seg.steps))
+	}
+	t.Duration = seconds(start)
+
+	// Rounding must not bring the steps closer together than the stepper can go
+	for k := 1; k < len(t.Steps); k++ {
+		if t.Steps[k] < t.Steps[k-1]+pulseDuration {
+			t.Steps[k] = t.Steps[k-1] + pulseDuration
+		}
+	}
+	if n := len(t.Steps); n > 0 && t.Duration < t.Steps[n-1]+pulseDuration {
+		t.Duration = t.Steps[n-1] + pulseDuration
+	}
+	return t
+}
+
+// Queue a motion program with the speeds and acceleration in the settings. Segments without a speed of their own
+// take the speed in the settings.
+func (pg *PlateGenie) queueProgram(segments []Segment, s Settings) (*motionQueue, error) {
+	settingsSpeed, err := pg.speedPercentage(s)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &motionQueue{}
+	for k, seg := range segments {
+		if err := seg.Validate(); err != nil {
+			return nil, fmt.Errorf("Segment %d: %w", k, err)
+		}
+		speedPercentage := float64(seg.SpeedPercentage)
+		if speedPercentage == 0 {
+			speedPercentage = settingsSpeed
+		}
+		velocity := pg.maxStepsPerSecond() * speedPercentage / 100
+		_, numSteps := direction(seg.Steps)
+		acceleration, err := pg.trapezoidalAcceleration(s, numSteps, velocity)
+		if err != nil {
+			return nil, err
+		}
+		q.push(seg.Steps, velocity, acceleration, time.Duration(seg.DwellMilliseconds)*time.Millisecond)
+	}
+	return q, nil
+}
+
+// Play the queued runs in order, with the dwell after each one. The caller is responsible for putting the machine into
+// a motion state first. A feed hold comes to rest and plans the rest of the run again once it is resumed.
+func (pg *PlateGenie) playQueue(ctx context.Context, q *motionQueue) error {
+	pulseDuration := pg.stepper.GetPulseDuration()
+
+	for _, run := range q.runs {
+		run := run
+		numSteps := 0
+		for _, seg := range run.segments {
+			numSteps += seg.steps
+		}
+		if !run.forward {
+			numSteps = -numSteps
+		}
+
+		err := pg.moveTimeline(ctx, numSteps, func(numStepsSigned int) (Timeline, error) {
+			_, n := direction(numStepsSigned)
+			return blendTimeline(run.forward, tailSegments(run.segments, n), pulseDuration), nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if run.dwell > 0 {
+			if _, err := pg.pause(ctx, nil, time.Now().Add(run.dwell)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package plateGenie
+
+import (
+	"testing"
+)
+
+func TestBlendTimelineHold(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []queuedSegment
+	}{
+		{"One segment", []queuedSegment{{400, 1000, 20000}}},
+		{"Faster second segment", []queuedSegment{{100, 1000, 20000}, {400, 3000, 20000}}},
+		{"Slower second segment", []queuedSegment{{400, 3000, 20000}, {100, 1000, 20000}}},
+		{"Short first segment", []queuedSegment{{10, 1000, 20000}, {400, 1000, 5000}}},
+	}
+	for _, test := range tests {
+		tl := blendTimeline(true, test.segments, testPulse)
+		if err := tl.Check(testPulse); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		last := test.segments[len(test.segments)-1]
+		if tl.Decel < len(tl.Steps)-last.steps || tl.Decel > len(tl.Steps) {
+			t.Errorf("%s: deceleration from %d of %d steps", test.name, tl.Decel, len(tl.Steps))
+		}
+
+		// A hold anywhere before the end comes to rest from the speed the carriage is at, without jumping
+		for k := 1; k < tl.Decel; k++ {
+			stop := tl.stopFrom(k)
+			if len(stop.Steps) > len(tl.Steps)-k {
+				t.Errorf("%s: stop from step %d takes %d steps, more than are left", test.name, k, len(stop.Steps))
+				break
+			}
+			if err := stop.Check(testPulse); err != nil {
+				t.Errorf("%s: stop from step %d: %v", test.name, k, err)
+				break
+			}
+			if len(stop.Steps) < 2 {
+				continue
+			}
+			current, first := tl.interval(k-1), stop.interval(0)
+			if first < current*98/100 || first > current*3/2 {
+				t.Errorf("%s: stop from step %d starts with %v after %v", test.name, k, first, current)
+				break
+			}
+		}
+	}
+}
+
+func TestTailSegments(t *testing.T) {
+	segments := []queuedSegment{{400, 2000, 20000}, {100, 1000, 20000}}
+	tests := []struct {
+		numSteps int
+		want     []int
+	}{
+		{500, []int{400, 100}},
+		{150, []int{50, 100}},
+		{100, []int{100}},
+		{30, []int{30}},
+		{0, nil},
+	}
+	for _, test := range tests {
+		tail := tailSegments(segments, test.numSteps)
+		var got []int
+		for _, seg := range tail {
+			got = append(got, seg.steps)
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("Last %d steps: got %v, want %v", test.numSteps, got, test.want)
+			continue
+		}
+		for k := range got {
+			if got[k] != test.want[k] {
+				t.Errorf("Last %d steps: got %v, want %v", test.numSteps, got, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,340 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// How the carriage moves during a phase
+type Pattern string
+
+const (
+	// Back and forth strokes for the whole phase
+	PatternContinuous Pattern = "continuous"
+	// Strokes for AgitateSeconds at the start of every IntervalSeconds, parked in the centre in between
+	PatternInterval Pattern = "interval"
+	// Back and forth strokes for the whole phase, each with a length, a speed and a dwell picked at random between
+	// the phase's minimum and its setting. Breaks up the standing waves that regular strokes set up.
+	PatternRandom Pattern = "random"
+)
+
+// Every pattern, in the order offered by the recipe editor
+var patterns = []Pattern{PatternContinuous, PatternInterval, PatternRandom}
+
+// One step of a process, e.g. develop, stop or fix
+type Phase struct {
+	Name string `json:"name"`
+	// Length of the phase in seconds and in strokes. The phase ends on whichever comes first. Either one can be 0 for
+	// no limit, but not both.
+	Seconds int `json:"seconds"`
+	Strokes int `json:"strokes,omitempty"`
+	// Same meaning as in Settings
+	SpeedPercentage          int     `json:"speedPercentage,omitempty"`
+	ConstantSpeedPercentage  int     `json:"constantSpeedPercentage,omitempty"`
+	TravelPercentage         int     `json:"travelPercentage,omitempty"`
+	SpeedMmPerSecond         float64 `json:"speedMmPerSecond,omitempty"`
+	AccelerationMmPerSecond2 float64 `json:"accelerationMmPerSecond2,omitempty"`
+	TravelMm                 float64 `json:"travelMm,omitempty"`
+	Pattern                  Pattern `json:"pattern"`
+	// Pause at each end of the stroke in milliseconds
+	DwellMilliseconds int `json:"dwellMilliseconds,omitempty"`
+	// Velocity profile of the strokes. Empty is trapezoidal.
+	Profile Profile `json:"profile,omitempty"`
+
+	// Interval pattern only. IntervalSeconds 0 agitates once at the start of the phase and rests for the rest of it,
+	// e.g. for stand development.
+	AgitateSeconds  int `json:"agitateSeconds,omitempty"`
+	IntervalSeconds int `json:"intervalSeconds,omitempty"`
+	// De-energize the coils while resting
+	ReleaseCoils bool `json:"releaseCoils,omitempty"`
+
+	// Random pattern only. Lower bounds for SpeedPercentage, TravelPercentage and DwellMilliseconds, which are the
+	// upper bounds. The bounds in mm are used with the settings in mm.
+	MinSpeedPercentage   int     `json:"minSpeedPercentage,omitempty"`
+	MinTravelPercentage  int     `json:"minTravelPercentage,omitempty"`
+	MinDwellMilliseconds int     `json:"minDwellMilliseconds,omitempty"`
+	MinSpeedMmPerSecond  float64 `json:"minSpeedMmPerSecond,omitempty"`
+	MinTravelMm          float64 `json:"minTravelMm,omitempty"`
+}
+
+// An ordered list of phases run as one agitation cycle
+type Recipe struct {
+	Name   string  `json:"name"`
+	Phases []Phase `json:"phases"`
+}
+
+// Motion settings for the phase
+func (p Phase) settings() Settings {
+	// Only trapezoidal strokes have a time at constant speed, but the moves between intervals still need one
+	if p.Profile != "" && p.Profile != ProfileTrapezoidal && p.ConstantSpeedPercentage == 0 {
+		p.ConstantSpeedPercentage = defaultConstantSpeedPercentage
+	}
+	return Settings{
+		SpeedPercentage:          p.SpeedPercentage,
+		ConstantSpeedPercentage:  p.ConstantSpeedPercentage,
+		TravelPercentage:         p.TravelPercentage,
+		SpeedMmPerSecond:         p.SpeedMmPerSecond,
+		AccelerationMmPerSecond2: p.AccelerationMmPerSecond2,
+		TravelMm:                 p.TravelMm,
+		AgitationSeconds:         p.Seconds,
+		AgitationStrokes:         p.Strokes,
+		DwellMilliseconds:        p.DwellMilliseconds,
+		Profile:                  p.Profile,
+	}
+}
+
+func (p Phase) validate() error {
+	if p.Seconds < 0 || p.Seconds > maxAgitationSeconds {
+		return &RangeError{"Seconds", p.Seconds, 0, maxAgitationSeconds}
+	}
+	if p.Strokes < 0 || p.Strokes > maxAgitationStrokes {
+		return &RangeError{"Strokes", p.Strokes, 0, maxAgitationStrokes}
+	}
+	if p.Seconds == 0 && p.Strokes == 0 {
+		return errors.New("Set seconds or strokes")
+	}
+	if err := p.settings().Validate(); err != nil {
+		return err
+	}
+	switch p.Pattern {
+	case PatternContinuous:
+	case PatternInterval:
+		longest := p.Seconds
+		if longest == 0 {
+			longest = maxAgitationSeconds
+		}
+		if p.AgitateSeconds < 1 || p.AgitateSeconds > longest {
+			return &RangeError{"Agitate seconds", p.AgitateSeconds, 1, longest}
+		}
+		if p.IntervalSeconds != 0 && (p.IntervalSeconds < p.AgitateSeconds || p.IntervalSeconds > longest) {
+			return &RangeError{"Interval seconds", p.IntervalSeconds, p.AgitateSeconds, longest}
+		}
+		// A single burst needs the phase time to know when to end
+		if p.IntervalSeconds == 0 && p.Seconds == 0 {
+			return errors.New("Set seconds for a single burst")
+		}
+	case PatternRandom:
+		if p.SpeedMmPerSecond != 0 {
+			if p.MinSpeedMmPerSecond <= 0 || p.MinSpeedMmPerSecond > p.SpeedMmPerSecond {
+				return fmt.Errorf("%w: Min speed mm/s %g is out of range (0, %g]", ErrOutOfRange,
+					p.MinSpeedMmPerSecond, p.SpeedMmPerSecond)
+			}
+		} else if p.MinSpeedPercentage < 1 || p.MinSpeedPercentage > p.SpeedPercentage {
+			return &RangeError{"Min speed percentage", p.MinSpeedPercentage, 1, p.SpeedPercentage}
+		}
+		if p.TravelMm != 0 {
+			if p.MinTravelMm <= 0 || p.MinTravelMm > p.TravelMm {
+				return fmt.Errorf("%w: Min travel mm %g is out of range (0, %g]", ErrOutOfRange, p.MinTravelMm,
+					p.TravelMm)
+			}
+		} else if p.MinTravelPercentage < 1 || p.MinTravelPercentage > p.TravelPercentage {
+			return &RangeError{"Min travel percentage", p.MinTravelPercentage, 1, p.TravelPercentage}
+		}
+		if p.MinDwellMilliseconds < 0 || p.MinDwellMilliseconds > p.DwellMilliseconds {
+			return &RangeError{"Min dwell milliseconds", p.MinDwellMilliseconds, 0, p.DwellMilliseconds}
+		}
+	case "":
+		return errors.New("Missing pattern")
+	default:
+		return fmt.Errorf("Unknown pattern %q", p.Pattern)
+	}
+	return nil
+}
+
+// Check every phase. Returns a *RecipeError for the first problem found.
+func (r Recipe) Validate() error {
+	if r.Name == "" {
+		return &RecipeError{Recipe: r.Name, Err: errors.New("No name")}
+	}
+	if len(r.Phases) == 0 {
+		return &RecipeError{Recipe: r.Name, Err: errors.New("No phases")}
+	}
+	for k, p := range r.Phases {
+		if err := p.validate(); err != nil {
+			return &RecipeError{Recipe: r.Name, Phase: k + 1, Err: err}
+		}
+	}
+	return nil
+}
+
+// Length of all of the phases together in seconds
+func (r Recipe) totalSeconds() int {
+	seconds := 0
+	for _, p := range r.Phases {
+		seconds += p.Seconds
+	}
+	return seconds
+}
+
+// Whether any phase picks its strokes at random
+func (r Recipe) random() bool {
+	for _, p := range r.Phases {
+		if p.Pattern == PatternRandom {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy that does not share the phases with r
+func (r Recipe) clone() Recipe {
+	r.Phases = append([]Phase(nil), r.Phases...)
+	return r
+}
+
+// Select the recipe run by the Agitation Cycle menu item. nil goes back to agitating with the current settings.
+func (pg *PlateGenie) SelectRecipe(r *Recipe) error {
+	var selected *Recipe
+	if r != nil {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		c := r.clone()
+		selected = &c
+	}
+
+	pg.mu.Lock()
+	pg.recipe = selected
+	pg.mu.Unlock()
+
+	return nil
+}
+
+// Recipe selected for the Agitation Cycle menu item, or nil if none is
+func (pg *PlateGenie) SelectedRecipe() *Recipe {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	if pg.recipe == nil {
+		return nil
+	}
+	c := pg.recipe.clone()
+	return &c
+}
+
+// Start running the phases of a recipe in order. Returns once the cycle has started. After the last phase the
+// carriage returns to the centre. StopAgitation ends the whole recipe at the end of the current stroke. Random phases
+// are seeded from the clock, and the seed is kept in the run history.
+func (pg *PlateGenie) RunRecipe(ctx context.Context, r Recipe) error {
+	return pg.RunRecipeWithSeed(ctx, r, time.Now().UnixNano())
+}
+
+// Same as RunRecipe, with the seed for random phases taken from the run history of an earlier run. The strokes are
+// the same as in that run, as long as the phases are the same.
+func (pg *PlateGenie) RunRecipeWithSeed(ctx context.Context, r Recipe, seed int64) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	r = r.clone()
+
+	phaseStatus := func(k int) AgitationStatus {
+		return AgitationStatus{
+			Recipe:      r.Name,
+			Phase:       r.Phases[k].Name,
+			PhaseNumber: k + 1,
+			PhaseCount:  len(r.Phases),
+			StrokeLimit: r.Phases[k].Strokes,
+		}
+	}
+	// Zero for a phase that is only limited by strokes
+	phaseDeadline := func(k int) time.Time {
+		if r.Phases[k].Seconds == 0 {
+			return time.Time{}
+		}
+		return time.Now().Add(time.Duration(r.Phases[k].Seconds) * time.Second)
+	}
+
+	record := RunRecord{Recipe: r.Name}
+	if r.random() {
+		record.Seed = seed
+		fmt.Println("Random seed", seed)
+	}
+
+	deadline := phaseDeadline(0)
+	return pg.startCycle(ctx, "Recipe "+r.Name, record, phaseStatus(0), deadline,
+		func(stop <-chan struct{}) (bool, error) {
+			for k, p := range r.Phases {
+				if k > 0 {
+					deadline = phaseDeadline(k)
+					pg.setAgitationStatus(phaseStatus(k), deadline)
+				}
+				fmt.Printf("Recipe %s phase %d/%d: %s\n", r.Name, k+1, len(r.Phases), p.Name)
+
+				// Each phase has its own sequence, so that how long one phase ran does not change the next one
+				limited, err := pg.runPhase(ctx, stop, deadline, p, seed+int64(k))
+				if err != nil || !limited {
+					return false, err
+				}
+			}
+			return true, pg.returnToCentre(ctx)
+		})
+}
+
+// Agitate with the phase's pattern until the deadline or the stroke limit. Returns true if a limit ended the phase.
+func (pg *PlateGenie) runPhase(ctx context.Context, stop <-chan struct{}, deadline time.Time, p Phase,
+	seed int64) (bool, error) {
+
+	s := p.settings()
+	settings := func() Settings { return s }
+
+	switch p.Pattern {
+	case PatternContinuous:
+		return pg.agitate(ctx, stop, deadline, p.Strokes, settings)
+	case PatternInterval:
+		return pg.agitateIntervals(ctx, stop, deadline, p)
+	case PatternRandom:
+		return pg.agitate(ctx, stop, deadline, p.Strokes, p.randomSettings(seed))
+	}
+	return false, fmt.Errorf("Unknown pattern %q", p.Pattern)
+}
+
+// Settings for every stroke of a random phase. The same seed gives the same strokes.
+func (p Phase) randomSettings(seed int64) func() Settings {
+	rnd := rand.New(rand.NewSource(seed))
+	between := func(min, max int) int {
+		return min + rnd.Intn(max-min+1)
+	}
+	betweenMm := func(min, max float64) float64 {
+		return min + rnd.Float64()*(max-min)
+	}
+	return func() Settings {
+		s := p.settings()
+		if p.SpeedMmPerSecond != 0 {
+			s.SpeedMmPerSecond = betweenMm(p.MinSpeedMmPerSecond, p.SpeedMmPerSecond)
+		} else {
+			s.SpeedPercentage = between(p.MinSpeedPercentage, p.SpeedPercentage)
+		}
+		if p.TravelMm != 0 {
+			s.TravelMm = betweenMm(p.MinTravelMm, p.TravelMm)
+		} else {
+			s.TravelPercentage = between(p.MinTravelPercentage, p.TravelPercentage)
+		}
+		s.DwellMilliseconds = between(p.MinDwellMilliseconds, p.DwellMilliseconds)
+		return s
+	}
+}
@@ -0,0 +1,125 @@
+package plateGenie
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRecipeValidate(t *testing.T) {
+	continuous := Phase{Name: "Develop", Seconds: 60, SpeedPercentage: 50, ConstantSpeedPercentage: 50,
+		TravelPercentage: 50, Pattern: PatternContinuous}
+	with := func(change func(p *Phase)) Recipe {
+		p := continuous
+		change(&p)
+		return Recipe{Name: "C41", Phases: []Phase{continuous, p}}
+	}
+
+	tests := []struct {
+		name   string
+		recipe Recipe
+		// Phase of the problem, numbered from 1. -1 if the recipe is valid.
+		phase int
+		want  error
+	}{
+		{"Valid", with(func(p *Phase) {}), -1, nil},
+		{"Strokes only", with(func(p *Phase) { p.Seconds = 0; p.Strokes = 20 }), -1, nil},
+		{"No name", Recipe{Phases: []Phase{continuous}}, 0, nil},
+		{"No phases", Recipe{Name: "C41"}, 0, nil},
+		{"No length", with(func(p *Phase) { p.Seconds = 0 }), 2, nil},
+		{"Negative seconds", with(func(p *Phase) { p.Seconds = -1 }), 2, ErrOutOfRange},
+		{"Too many strokes", with(func(p *Phase) { p.Strokes = maxAgitationStrokes + 1 }), 2, ErrOutOfRange},
+		{"Speed", with(func(p *Phase) { p.SpeedPercentage = 0 }), 2, ErrOutOfRange},
+		{"Missing pattern", with(func(p *Phase) { p.Pattern = "" }), 2, nil},
+		{"Unknown pattern", with(func(p *Phase) { p.Pattern = "swirl" }), 2, nil},
+		{"Unknown profile", with(func(p *Phase) { p.Profile = "square" }), 2, nil},
+	}
+	for _, test := range tests {
+		err := test.recipe.Validate()
+		if test.phase < 0 {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		var recipeErr *RecipeError
+		if !errors.As(err, &recipeErr) || !errors.Is(err, ErrInvalidRecipe) {
+			t.Errorf("%s: got %v, want a RecipeError", test.name, err)
+			continue
+		}
+		if recipeErr.Phase != test.phase {
+			t.Errorf("%s: problem in phase %d, want %d", test.name, recipeErr.Phase, test.phase)
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestSelectRecipe(t *testing.T) {
+	pg := &PlateGenie{}
+	r := Recipe{Name: "C41", Phases: []Phase{{Name: "Develop", Seconds: 60, SpeedPercentage: 50,
+		ConstantSpeedPercentage: 50, TravelPercentage: 50, Pattern: PatternContinuous}}}
+	if err := pg.SelectRecipe(&r); err != nil {
+		t.Fatal(err)
+	}
+
+	// The selection is a copy
+	r.Phases[0].Seconds = 0
+	if s := pg.SelectedRecipe(); s == nil || s.Phases[0].Seconds != 60 {
+		t.Errorf("Selected recipe changed with the original: %+v", s)
+	}
+	if err := pg.SelectRecipe(&r); !errors.Is(err, ErrInvalidRecipe) {
+		t.Errorf("Invalid recipe: got %v, want ErrInvalidRecipe", err)
+	}
+	if s := pg.SelectedRecipe(); s == nil || s.Phases[0].Seconds != 60 {
+		t.Errorf("Invalid recipe replaced the selection: %+v", s)
+	}
+
+	if err := pg.SelectRecipe(nil); err != nil || pg.SelectedRecipe() != nil {
+		t.Errorf("Selecting nil: got %v, selected %+v", err, pg.SelectedRecipe())
+	}
+}
+
+func TestRandomSettings(t *testing.T) {
+	p := Phase{Name: "Develop", Strokes: 50, SpeedPercentage: 90, ConstantSpeedPercentage: 50, TravelPercentage: 80,
+		DwellMilliseconds: 500, Pattern: PatternRandom, MinSpeedPercentage: 40, MinTravelPercentage: 20,
+		MinDwellMilliseconds: 100}
+	if err := p.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	strokes := func(seed int64) []Settings {
+		next := p.randomSettings(seed)
+		var s []Settings
+		for k := 0; k < 50; k++ {
+			s = append(s, next())
+		}
+		return s
+	}
+	first, again, other := strokes(42), strokes(42), strokes(43)
+
+	same := 0
+	for k, s := range first {
+		if s != again[k] {
+			t.Fatalf("Stroke %d with the same seed: %+v, then %+v", k, s, again[k])
+		}
+		if s == other[k] {
+			same++
+		}
+		if s.SpeedPercentage < 40 || s.SpeedPercentage > 90 || s.TravelPercentage < 20 || s.TravelPercentage > 80 ||
+			s.DwellMilliseconds < 100 || s.DwellMilliseconds > 500 {
+			t.Errorf("Stroke %d out of bounds: %+v", k, s)
+		}
+		if err := s.Validate(); err != nil {
+			t.Errorf("Stroke %d: %v", k, err)
+		}
+	}
+	if same == len(first) {
+		t.Error("Another seed gave the same strokes")
+	}
+
+	p.MinTravelPercentage = 90
+	if err := p.validate(); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Lower bound above the setting: got %v, want ErrOutOfRange", err)
+	}
+}
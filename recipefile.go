@@ -0,0 +1,359 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Recipe files are JSON, one recipe per file, with a .json extension:
+//
+//	{
+//		"version": 1,
+//		"name": "C-41",
+//		"phases": [
+//			{"name": "Develop", "seconds": 195, "speedPercentage": 80, "constantSpeedPercentage": 70,
+//				"travelPercentage": 50, "pattern": "continuous"},
+//			{"name": "Stop", "seconds": 0, "strokes": 40, "speedPercentage": 80, "constantSpeedPercentage": 70,
+//				"travelPercentage": 50, "pattern": "continuous"},
+//			{"name": "Stand", "seconds": 3600, "speedPercentage": 50, "constantSpeedPercentage": 70,
+//				"travelPercentage": 50, "pattern": "interval", "agitateSeconds": 30, "intervalSeconds": 0,
+//				"releaseCoils": true},
+//			...
+//		]
+//	}
+//
+// strokes is optional and ends the phase after that many strokes, or at the end of its seconds if that comes first.
+// seconds can be 0 when strokes is set. agitateSeconds, intervalSeconds and releaseCoils are only used by the interval
+// pattern. dwellMilliseconds is optional and pauses at each end of the stroke. profile is optional, either
+// "trapezoidal", "sinusoidal" or "scurve", and trapezoidal if left out. minSpeedPercentage, minTravelPercentage and
+// minDwellMilliseconds are only used by the random pattern, which picks every stroke between them and speedPercentage,
+// travelPercentage and dwellMilliseconds. Every other field is required. version is the schema version below and is
+// bumped whenever an existing file would be read differently.
+//
+// speedMmPerSecond, accelerationMmPerSecond2 and travelMm, and minSpeedMmPerSecond and minTravelMm for the random
+// pattern, can be given in place of the percentages. They mean the same on every rig, so use them for recipes that are
+// shared between rigs. The percentages are then optional.
+
+const (
+	// Schema version written in recipe files
+	RecipeSchemaVersion = 1
+	// How often the recipe directory is checked for changes
+	recipeScanInterval = 2 * time.Second
+)
+
+type recipeFile struct {
+	Version *int `json:"version"`
+	Recipe
+}
+
+// Parse and validate one recipe file. Errors give the line and column of JSON problems.
+func ParseRecipe(data []byte) (Recipe, error) {
+	var f recipeFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return Recipe{}, fmt.Errorf("%s: %v", position(data, syntaxErr.Offset), err)
+		case errors.As(err, &typeErr):
+			return Recipe{}, fmt.Errorf("%s: %s should be a %v, not a %s", position(data, typeErr.Offset),
+				typeErr.Field, typeErr.Type, typeErr.Value)
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return Recipe{}, errors.New("File ends part way through the recipe")
+		}
+		return Recipe{}, err
+	}
+	if dec.More() {
+		return Recipe{}, errors.New("Unexpected data after the recipe")
+	}
+
+	if f.Version == nil {
+		return Recipe{}, errors.New("Missing schema version")
+	}
+	if *f.Version != RecipeSchemaVersion {
+		return Recipe{}, fmt.Errorf("Unsupported schema version %d, expected %d", *f.Version, RecipeSchemaVersion)
+	}
+	if err := f.Recipe.Validate(); err != nil {
+		return Recipe{}, err
+	}
+
+	return f.Recipe, nil
+}
+
+// Line and column of the last byte read by the decoder, given the offset after it. For a syntax error that is the
+// byte at fault.
+func position(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	if offset > 0 {
+		offset--
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d", line, column)
+}
+
+// Read one recipe file
+func LoadRecipe(path string) (Recipe, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Recipe{}, err
+	}
+	r, err := ParseRecipe(data)
+	if err != nil {
+		return Recipe{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Read every .json file in a directory in file name order. Files that cannot be loaded, and recipes with the same name
+// as one already loaded, are skipped and reported in the errors.
+func LoadRecipes(dir string) ([]Recipe, []error) {
+	recipes, _, errs := loadRecipeFiles(dir)
+	return recipes, errs
+}
+
+// Same as LoadRecipes, along with the path of each recipe
+func loadRecipeFiles(dir string) ([]Recipe, []string, []error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, nil, []error{err}
+	}
+	sort.Strings(paths)
+
+	var recipes []Recipe
+	var loaded []string
+	var errs []error
+	seen := make(map[string]string)
+	for _, path := range paths {
+		r, err := LoadRecipe(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if other, ok := seen[r.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s: Recipe %q is already loaded from %s", path, r.Name, other))
+			continue
+		}
+		seen[r.Name] = path
+		recipes = append(recipes, r)
+		loaded = append(loaded, path)
+	}
+
+	return recipes, loaded, errs
+}
+
+// Validate a recipe and write it in the recipe file format
+func SaveRecipe(path string, r Recipe) error {
+	if err := r.Validate(); err != nil {
+		return err
+	}
+	version := RecipeSchemaVersion
+	data, err := json.MarshalIndent(recipeFile{Version: &version, Recipe: r}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// Names, sizes and modification times of the recipe files, used to notice changes
+func recipeDirSignature(dir string) string {
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	sort.Strings(paths)
+
+	var sig strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(&sig, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return sig.String()
+}
+
+// Load the recipe directory and replace the loaded recipes. Returns the signature of the directory as it was before
+// loading.
+func (pg *PlateGenie) loadRecipeDir() string {
+	dir := pg.config.RecipeDir
+	sig := recipeDirSignature(dir)
+	recipes, paths, errs := loadRecipeFiles(dir)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	fmt.Printf("Loaded %d recipes from %s\n", len(recipes), dir)
+	pg.setRecipes(recipes, paths)
+	return sig
+}
+
+// Reload the recipe directory whenever the files change from the given signature
+func (pg *PlateGenie) watchRecipeDir(ctx context.Context, sig string) {
+	ticker := time.NewTicker(recipeScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		newSig := recipeDirSignature(pg.config.RecipeDir)
+		if newSig == sig {
+			continue
+		}
+		fmt.Println("Recipe directory changed")
+		sig = pg.loadRecipeDir()
+	}
+}
+
+func (pg *PlateGenie) setRecipes(recipes []Recipe, paths []string) {
+	pg.mu.Lock()
+	pg.recipes = recipes
+	pg.recipePaths = paths
+	// Follow changes to the selected recipe, and drop it if it is gone
+	if pg.recipe != nil {
+		name := pg.recipe.Name
+		pg.recipe = nil
+		for _, r := range recipes {
+			if r.Name == name {
+				c := r.clone()
+				pg.recipe = &c
+			}
+		}
+		if pg.recipe == nil {
+			fmt.Printf("Selected recipe %s is no longer available\n", name)
+		}
+	}
+	pg.mu.Unlock()
+
+	pg.showRecipes()
+}
+
+// Recipes loaded from the recipe directory
+func (pg *PlateGenie) Recipes() []Recipe {
+	recipes, _ := pg.recipeFiles()
+	return recipes
+}
+
+// Loaded recipes and the file that each one came from
+func (pg *PlateGenie) recipeFiles() ([]Recipe, []string) {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	recipes := make([]Recipe, len(pg.recipes))
+	for k, r := range pg.recipes {
+		recipes[k] = r.clone()
+	}
+	return recipes, append([]string(nil), pg.recipePaths...)
+}
+
+// Move the Recipes menu item on to the next loaded recipe. The entry after the last recipe is no recipe at all, which
+// agitates with the settings.
+func (pg *PlateGenie) browseNextRecipe() {
+	pg.mu.Lock()
+	next := 0
+	if pg.recipeBrowse != "" {
+		for k, r := range pg.recipes {
+			if r.Name == pg.recipeBrowse {
+				next = k + 1
+			}
+		}
+	}
+	pg.recipeBrowse = ""
+	if next < len(pg.recipes) {
+		pg.recipeBrowse = pg.recipes[next].Name
+	}
+	pg.mu.Unlock()
+
+	pg.showRecipes()
+}
+
+// Select the recipe showing on the Recipes menu item
+func (pg *PlateGenie) selectBrowsedRecipe() {
+	pg.mu.Lock()
+	var selected *Recipe
+	for _, r := range pg.recipes {
+		if r.Name == pg.recipeBrowse {
+			c := r.clone()
+			selected = &c
+		}
+	}
+	pg.recipe = selected
+	pg.mu.Unlock()
+
+	if selected != nil {
+		fmt.Println("Selected recipe", selected.Name)
+	} else {
+		fmt.Println("Agitating with the settings")
+	}
+	pg.showRecipes()
+}
+
+// Update the Recipes menu item: the browsed recipe on the units line and its length on the values line. A star marks
+// the selected recipe.
+func (pg *PlateGenie) showRecipes() {
+	if pg.recipeItem == nil {
+		return
+	}
+
+	pg.mu.Lock()
+	name := "(Settings)"
+	values := ""
+	selected := pg.recipe == nil
+	for _, r := range pg.recipes {
+		if r.Name == pg.recipeBrowse {
+			name = r.Name
+			values = fmt.Sprintf("%d phases %s", len(r.Phases), formatMinSec(r.totalSeconds()))
+			selected = pg.recipe != nil && pg.recipe.Name == r.Name
+		}
+	}
+	if name == "(Settings)" {
+		values = fmt.Sprintf("%d recipes", len(pg.recipes))
+	}
+	pg.mu.Unlock()
+
+	if selected {
+		values = "* " + values
+	}
+	if len(name) > 20 {
+		name = name[:20]
+	}
+	pg.menu.SetText(pg.recipeItem, name, values)
+}
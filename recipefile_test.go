@@ -0,0 +1,96 @@
+package plateGenie
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testPhase = `{"name": "Develop", "seconds": 60, "speedPercentage": 50, "constantSpeedPercentage": 50,
+	"travelPercentage": 50, "pattern": "continuous"}`
+
+func TestParseRecipeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"Syntax", "{\n\t\"version\": 1,\n\t\"name\": \"C41\"\n\t\"phases\": []\n}", "line 4, column 2"},
+		{"Type", "{\n\t\"version\": 1,\n\t\"name\": 41\n}", "line 3, column 11: name should be a string, not a number"},
+		{"Truncated", `{"version": 1, "name": "C41"`, "File ends part way through the recipe"},
+		{"Trailing data", `{"version": 1, "name": "C41", "phases": [` + testPhase + `]} {}`, "Unexpected data"},
+		{"Unknown field", `{"version": 1, "name": "C41", "phases": [], "notes": ""}`, `unknown field "notes"`},
+		{"No version", `{"name": "C41", "phases": [` + testPhase + `]}`, "Missing schema version"},
+		{"Newer version", `{"version": 2, "name": "C41", "phases": [` + testPhase + `]}`,
+			"Unsupported schema version 2"},
+		{"Invalid", `{"version": 1, "name": "C41", "phases": []}`, `Recipe "C41": No phases`},
+	}
+	// The columns count a tab as one
+	for _, test := range tests {
+		_, err := ParseRecipe([]byte(test.data))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+
+	_, err := ParseRecipe([]byte(`{"version": 1, "name": "C41", "phases": []}`))
+	if !errors.Is(err, ErrInvalidRecipe) {
+		t.Errorf("Invalid recipe: got %v, want ErrInvalidRecipe", err)
+	}
+}
+
+func TestLoadRecipes(t *testing.T) {
+	dir := t.TempDir()
+	example, err := ioutil.ReadFile("app/recipes/c41.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.json":    string(example),
+		"b.json":    string(example),
+		"c.json":    "{",
+		"d.json":    `{"version": 1, "name": "Quick", "phases": [` + testPhase + `]}`,
+		"notes.txt": "Not a recipe",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recipes, errs := LoadRecipes(dir)
+	if len(recipes) != 2 || recipes[1].Name != "Quick" {
+		t.Errorf("Loaded %+v", recipes)
+	}
+	// The duplicate and the broken file
+	if len(errs) != 2 || !strings.Contains(errs[0].Error(), "already loaded from") ||
+		!strings.HasPrefix(errs[1].Error(), filepath.Join(dir, "c.json")) {
+		t.Errorf("Errors %v", errs)
+	}
+}
+
+func TestSaveRecipe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c41.json")
+	r, err := LoadRecipe("app/recipes/c41.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveRecipe(path, r); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := LoadRecipe(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved, r) {
+		t.Errorf("Saved %+v, loaded %+v", r, saved)
+	}
+
+	r.Phases = nil
+	if err := SaveRecipe(path, r); !errors.Is(err, ErrInvalidRecipe) {
+		t.Errorf("Invalid recipe: got %v, want ErrInvalidRecipe", err)
+	}
+}
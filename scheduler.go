@@ -0,0 +1,136 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+const (
+	// The last part of the wait for a step is spent polling the clock, since a sleep can overrun by about this much
+	stepSpinTime = 100 * time.Microsecond
+	// A step this late starts the schedule again from the current time instead of rushing the next steps to catch up
+	maxStepLateness = 10 * time.Millisecond
+	// Share of the planned time that a move may run over. Step times are planned to the nanosecond, so this is the
+	// tolerance on the speed of every move as long as the steps are not released late. Moves outside it are reported.
+	speedTolerance = 0.001
+)
+
+// Timing of the steps of a move. Lateness is how long after its deadline a step was released.
+type MoveTiming struct {
+	Steps   int
+	Worst   time.Duration
+	Average time.Duration
+	// Length of the move as planned and as it ran. Zero if the move was cut short.
+	Planned time.Duration
+	Actual  time.Duration
+}
+
+// Paces the steps of a move from absolute deadlines, so that the time taken by the steps themselves and the delays in
+// waking up do not add up over the move. Times come from the monotonic clock.
+type stepScheduler struct {
+	// Start of the move
+	begin time.Time
+	// Start of the schedule. Moved later when the schedule falls too far behind.
+	start time.Time
+	// Set by finish()
+	planned time.Duration
+	actual  time.Duration
+
+	steps int
+	worst time.Duration
+	total time.Duration
+}
+
+// Start a schedule now
+func newStepScheduler() *stepScheduler {
+	now := time.Now()
+	return &stepScheduler{begin: now, start: now}
+}
+
+// Wait until the deadline of a step, given as a time from the start of the move, and record how late it was
+func (s *stepScheduler) waitUntil(at time.Duration) {
+	late := s.wait(at)
+	s.steps++
+	s.total += late
+	if late > s.worst {
+		s.worst = late
+	}
+	if late > maxStepLateness {
+		s.start = s.start.Add(late)
+	}
+}
+
+// Wait for the end of the move after the last step
+func (s *stepScheduler) finish(at time.Duration) {
+	s.wait(at)
+	s.planned = at
+	s.actual = time.Since(s.begin)
+}
+
+// Sleep until just before the deadline and then poll the clock for the rest. Returns how late the wait ended.
+func (s *stepScheduler) wait(at time.Duration) time.Duration {
+	deadline := s.start.Add(at)
+	if wait := time.Until(deadline) - stepSpinTime; wait > 0 {
+		time.Sleep(wait)
+	}
+	for time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+	return time.Since(deadline)
+}
+
+func (s *stepScheduler) timing() MoveTiming {
+	t := MoveTiming{Steps: s.steps, Worst: s.worst, Planned: s.planned, Actual: s.actual}
+	if s.steps > 0 {
+		t.Average = s.total / time.Duration(s.steps)
+	}
+	return t
+}
+
+// Keep and print the timing of a finished move
+func (pg *PlateGenie) recordTiming(s *stepScheduler) {
+	t := s.timing()
+	if t.Steps == 0 {
+		return
+	}
+	fmt.Printf("%d steps, worst lateness %v, average %v\n", t.Steps, t.Worst, t.Average)
+	if t.Planned > 0 && float64(t.Actual-t.Planned) > speedTolerance*float64(t.Planned) {
+		fmt.Printf("Move took %v instead of %v, %.1f%% slower than planned\n", t.Actual, t.Planned,
+			100*float64(t.Actual-t.Planned)/float64(t.Planned))
+	}
+
+	pg.mu.Lock()
+	pg.lastMoveTiming = t
+	pg.mu.Unlock()
+}
+
+// Step timing of the last move
+func (pg *PlateGenie) LastMoveTiming() MoveTiming {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	return pg.lastMoveTiming
+}
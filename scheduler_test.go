@@ -0,0 +1,38 @@
+package plateGenie
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStepScheduler(t *testing.T) {
+	s := newStepScheduler()
+	for k := 1; k <= 20; k++ {
+		s.waitUntil(time.Duration(k) * time.Millisecond)
+	}
+	s.finish(21 * time.Millisecond)
+	tm := s.timing()
+	if tm.Steps != 20 || tm.Worst < tm.Average || tm.Planned != 21*time.Millisecond {
+		t.Errorf("Timing %+v", tm)
+	}
+	// The deadlines are absolute, so the lateness of each step does not add up
+	if tm.Actual < tm.Planned || tm.Actual > tm.Planned+5*time.Millisecond {
+		t.Errorf("Move planned for %v took %v", tm.Planned, tm.Actual)
+	}
+}
+
+func TestStepSchedulerLate(t *testing.T) {
+	s := newStepScheduler()
+	s.waitUntil(time.Millisecond)
+	time.Sleep(3 * maxStepLateness)
+	// Far behind, so the rest of the schedule starts again from now instead of rushing
+	s.waitUntil(2 * time.Millisecond)
+	start := time.Now()
+	s.waitUntil(12 * time.Millisecond)
+	if d := time.Since(start); d < 8*time.Millisecond {
+		t.Errorf("Step after a late one came %v later, want about 10ms", d)
+	}
+	if tm := s.timing(); tm.Steps != 3 || tm.Worst < 2*maxStepLateness {
+		t.Errorf("Timing %+v", tm)
+	}
+}
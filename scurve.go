@@ -0,0 +1,139 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"math"
+	"time"
+)
+
+// Shape of a rest to rest S-curve move. The acceleration ramps up at the jerk limit, holds, ramps down to cruise,
+// and the deceleration mirrors it. Times are in seconds.
+type sCurve struct {
+	jerk float64
+	// Peak velocity, lower than the limit if the move is too short to reach it
+	velocity float64
+	// Time to ramp the acceleration up or down
+	jerkTime float64
+	// Time at constant acceleration
+	accelTime float64
+	// Time at constant speed
+	cruiseTime float64
+}
+
+// Plan a move of distance steps within the velocity, acceleration and jerk limits. Moves too short to reach the
+// velocity limit peak at a lower velocity.
+func planSCurve(distance float64, velocity float64, acceleration float64, jerk float64) sCurve {
+	// Jerk and constant acceleration times to reach a velocity from rest
+	rampTimes := func(v float64) (float64, float64) {
+		if v*jerk >= acceleration*acceleration {
+			return acceleration / jerk, v/acceleration - acceleration/jerk
+		}
+		// The acceleration limit is never reached
+		return math.Sqrt(v / jerk), 0
+	}
+
+	jerkTime, accelTime := rampTimes(velocity)
+	// Distance covered speeding up and slowing down together
+	rampDistance := velocity * (2*jerkTime + accelTime)
+	if rampDistance > distance {
+		low, high := 0.0, velocity
+		for k := 0; k < 60; k++ {
+			mid := (low + high) / 2
+			jerkTime, accelTime = rampTimes(mid)
+			if mid*(2*jerkTime+accelTime) > distance {
+				high = mid
+			} else {
+				low = mid
+			}
+		}
+		velocity = low
+		jerkTime, accelTime = rampTimes(velocity)
+		rampDistance = velocity * (2*jerkTime + accelTime)
+	}
+
+	return sCurve{
+		jerk:       jerk,
+		velocity:   velocity,
+		jerkTime:   jerkTime,
+		accelTime:  accelTime,
+		cruiseTime: (distance - rampDistance) / velocity,
+	}
+}
+
+// Steps taken while speeding up to the peak velocity. Slowing down takes as many.
+func (c sCurve) rampSteps() float64 {
+	return c.velocity * (2*c.jerkTime + c.accelTime) / 2
+}
+
+// Time of every step from the start of the move, and the length of the move, in seconds. Step k is centred on the
+// time that the carriage reaches k+0.5 steps.
+func (c sCurve) stepTimes(numSteps int) ([]float64, float64) {
+	segments := []struct {
+		jerk     float64
+		duration float64
+	}{
+		{c.jerk, c.jerkTime}, {0, c.accelTime}, {-c.jerk, c.jerkTime},
+		{0, c.cruiseTime},
+		{-c.jerk, c.jerkTime}, {0, c.accelTime}, {c.jerk, c.jerkTime},
+	}
+
+	// Integrate in slices of a quarter of a step at full speed and interpolate within them
+	slice := 1 / c.velocity / 4
+	var t, x, v, a float64
+	times := make([]float64, 0, numSteps)
+	next := 0.5
+	for _, segment := range segments {
+		n := int(math.Ceil(segment.duration / slice))
+		if n == 0 {
+			continue
+		}
+		dt := segment.duration / float64(n)
+		for k := 0; k < n; k++ {
+			nextX := x + v*dt + a*dt*dt/2 + segment.jerk*dt*dt*dt/6
+			v += a*dt + segment.jerk*dt*dt/2
+			a += segment.jerk * dt
+			for len(times) < numSteps && nextX >= next {
+				times = append(times, t+dt*(next-x)/(nextX-x))
+				next++
+			}
+			x = nextX
+			t += dt
+		}
+	}
+	// Rounding can leave the last step short of its mark
+	for len(times) < numSteps {
+		times = append(times, t)
+	}
+	return times, t
+}
+
+// Sleep after each step of an S-curve move
+func (c sCurve) sleepTimes(numSteps int, pulseDuration time.Duration) []time.Duration {
+	times, duration := c.stepTimes(numSteps)
+	for k := range times {
+		times[k] *= float64(time.Second)
+	}
+	return sleepTimesBetween(times, duration*float64(time.Second), pulseDuration)
+}
@@ -0,0 +1,248 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// User adjustable settings for moves and agitation. The settings in mm take the place of the percentages when they
+// are not 0. See units.go.
+type Settings struct {
+	// Percentage of the maximum stepper speed for movements
+	SpeedPercentage int `json:"speedPercentage"`
+	// Percentage of time at constant speed during a trapezoidal movement
+	ConstantSpeedPercentage int `json:"constantSpeedPercentage"`
+	// Percentage of the maximum distance to move the carriage during agitation
+	TravelPercentage int `json:"travelPercentage"`
+	// Peak speed, acceleration and length of a stroke in mm
+	SpeedMmPerSecond         float64 `json:"speedMmPerSecond,omitempty"`
+	AccelerationMmPerSecond2 float64 `json:"accelerationMmPerSecond2,omitempty"`
+	TravelMm                 float64 `json:"travelMm,omitempty"`
+	// Length of an agitation cycle in seconds. 0 agitates until the cycle is ended by hand.
+	AgitationSeconds int `json:"agitationSeconds"`
+	// Number of strokes in an agitation cycle. 0 for no limit. The cycle ends on the time or the strokes, whichever
+	// comes first.
+	AgitationStrokes int `json:"agitationStrokes"`
+	// Pause at each end of the stroke in milliseconds, to let the liquid settle
+	DwellMilliseconds int `json:"dwellMilliseconds"`
+	// Velocity profile of the agitation strokes. Empty is trapezoidal.
+	Profile Profile `json:"profile"`
+}
+
+func defaultSettings() Settings {
+	return Settings{
+		SpeedPercentage:         defaultSpeedPercentage,
+		ConstantSpeedPercentage: defaultConstantSpeedPercentage,
+		TravelPercentage:        defaultTravelPercentage,
+		AgitationSeconds:        defaultAgitationSeconds,
+		AgitationStrokes:        defaultAgitationStrokes,
+		DwellMilliseconds:       defaultDwellMilliseconds,
+		Profile:                 ProfileTrapezoidal,
+	}
+}
+
+// Check the settings against the limits of the motion routines
+func (s Settings) Validate() error {
+	if err := checkMm("Speed mm/s", s.SpeedMmPerSecond); err != nil {
+		return err
+	}
+	if err := checkMm("Acceleration mm/s2", s.AccelerationMmPerSecond2); err != nil {
+		return err
+	}
+	if err := checkMm("Travel mm", s.TravelMm); err != nil {
+		return err
+	}
+	// The percentages are only needed where there is no setting in mm
+	if s.SpeedMmPerSecond == 0 && (s.SpeedPercentage < 1 || s.SpeedPercentage > 100) {
+		return &RangeError{"Speed percentage", s.SpeedPercentage, 1, 100}
+	}
+	if s.AccelerationMmPerSecond2 == 0 && (s.ConstantSpeedPercentage < 1 || s.ConstantSpeedPercentage > 99) {
+		return &RangeError{"Constant speed percentage", s.ConstantSpeedPercentage, 1, 99}
+	}
+	if s.TravelMm == 0 && (s.TravelPercentage < 1 || s.TravelPercentage > 100) {
+		return &RangeError{"Travel percentage", s.TravelPercentage, 1, 100}
+	}
+	if s.AgitationSeconds < 0 || s.AgitationSeconds > maxAgitationSeconds {
+		return &RangeError{"Agitation seconds", s.AgitationSeconds, 0, maxAgitationSeconds}
+	}
+	if s.AgitationStrokes < 0 || s.AgitationStrokes > maxAgitationStrokes {
+		return &RangeError{"Agitation strokes", s.AgitationStrokes, 0, maxAgitationStrokes}
+	}
+	if s.DwellMilliseconds < 0 || s.DwellMilliseconds > maxDwellMilliseconds {
+		return &RangeError{"Dwell milliseconds", s.DwellMilliseconds, 0, maxDwellMilliseconds}
+	}
+	switch s.Profile {
+	case "", ProfileTrapezoidal, ProfileSinusoidal, ProfileSCurve:
+	default:
+		return fmt.Errorf("Unknown profile %q", s.Profile)
+	}
+	return nil
+}
+
+// Settings in mm need the steps per mm calibration. Kept out of Validate since it depends on the configuration.
+func (s Settings) checkCalibration(stepsPerMm float64) error {
+	if stepsPerMm > 0 || (s.SpeedMmPerSecond == 0 && s.AccelerationMmPerSecond2 == 0 && s.TravelMm == 0) {
+		return nil
+	}
+	return fmt.Errorf("%w: Set stepper.stepsPerMm in the configuration to use settings in mm", ErrNotCalibrated)
+}
+
+// Read the settings saved by saveSettings(). Missing values take the defaults. A missing, unreadable or invalid file
+// gives the defaults. Settings in mm fall back to the percentages on a rig without a steps per mm calibration, e.g.
+// after the calibration has been taken out of the configuration.
+func loadSettings(path string, defaults Settings, stepsPerMm float64) Settings {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Println("No saved settings in", path+", using the defaults")
+		return defaults
+	}
+	if err != nil {
+		fmt.Println("Unable to read the saved settings, using the defaults:", err)
+		return defaults
+	}
+
+	s := defaults
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		fmt.Printf("Saved settings in %s are corrupt, using the defaults: %v\n", path, err)
+		return defaults
+	}
+	if err := s.checkCalibration(stepsPerMm); err != nil {
+		fmt.Printf("Saved settings in %s are in mm, using the percentages: %v\n", path, err)
+		s.SpeedMmPerSecond = 0
+		s.AccelerationMmPerSecond2 = 0
+		s.TravelMm = 0
+	}
+	if err := s.Validate(); err != nil {
+		fmt.Printf("Saved settings in %s are invalid, using the defaults: %v\n", path, err)
+		return defaults
+	}
+
+	fmt.Printf("Restored settings from %s: %+v\n", path, s)
+	return s
+}
+
+// Write the settings as indented JSON
+func saveSettings(path string, s Settings) error {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// Write a file so that it holds either the old or the new contents even if the power is cut part way through: write
+// a temporary file in the same directory, flush it to disk and rename it over the old one.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	// Does nothing once the rename has succeeded
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// Current settings
+func (pg *PlateGenie) Settings() Settings {
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	return pg.settings
+}
+
+// Replace the settings. Returns the validation error and keeps the old settings if the new ones are not valid, or if
+// they are in mm and the rig is not calibrated. The settings are saved the same as changes made from the menu.
+func (pg *PlateGenie) SetSettings(s Settings) error {
+	_, err := pg.updateSettings(func(current *Settings) { *current = s })
+	return err
+}
+
+// Apply a change to the settings. The change is discarded if the result is not valid. Returns the settings in effect
+// afterwards along with the validation error, if any. Valid changes are saved to the settings file if there is one. A
+// failed save is only printed since the new settings are still in effect until the next boot.
+func (pg *PlateGenie) updateSettings(change func(s *Settings)) (Settings, error) {
+	// Keep the saves in the same order as the changes without holding pg.mu during the file operations
+	pg.settingsFileMu.Lock()
+	defer pg.settingsFileMu.Unlock()
+
+	pg.mu.Lock()
+	s := pg.settings
+	change(&s)
+	err := s.Validate()
+	if err == nil {
+		err = s.checkCalibration(pg.config.Stepper.StepsPerMm)
+	}
+	if err != nil {
+		s = pg.settings
+		pg.mu.Unlock()
+		return s, err
+	}
+	pg.settings = s
+	pg.mu.Unlock()
+
+	if path := pg.config.SettingsFile; path != "" {
+		if err := saveSettings(path, s); err != nil {
+			fmt.Println("Unable to save the settings:", err)
+		}
+	}
+
+	return s, nil
+}
@@ -0,0 +1,126 @@
+package plateGenie
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSettingsRoundTrip(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "plategenie")
+	path := filepath.Join(dir, "settings.json")
+	pg := &PlateGenie{config: DefaultConfig(), settings: defaultSettings()}
+	pg.config.SettingsFile = path
+
+	s, err := pg.updateSettings(func(s *Settings) {
+		s.SpeedPercentage = 79
+		s.DwellMilliseconds = 250
+		s.Profile = ProfileSCurve
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := loadSettings(path, defaultSettings(), 0); got != s {
+		t.Errorf("Loaded %+v, want %+v", got, s)
+	}
+
+	// An invalid change is neither kept nor saved
+	if _, err := pg.updateSettings(func(s *Settings) { s.SpeedPercentage = 0 }); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Speed 0: got %v, want ErrOutOfRange", err)
+	}
+	if got := loadSettings(path, defaultSettings(), 0); got != s {
+		t.Errorf("Loaded %+v after an invalid change, want %+v", got, s)
+	}
+
+	// Only the settings file is left in the directory, without any temporary files
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "settings.json" {
+		t.Errorf("Files left behind: %v", files)
+	}
+}
+
+func TestLoadSettingsFallback(t *testing.T) {
+	defaults := defaultSettings()
+	defaults.TravelPercentage = 30
+	partial := defaults
+	partial.SpeedPercentage = 40
+
+	tests := []struct {
+		name string
+		data string
+		want Settings
+	}{
+		{"Corrupt", `{"speedPercentage": 4`, defaults},
+		{"Unknown field", `{"speed": 40}`, defaults},
+		{"Invalid", `{"dwellMilliseconds": -1}`, defaults},
+		{"Missing values", `{"speedPercentage": 40}`, partial},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "settings.json")
+		if err := ioutil.WriteFile(path, []byte(test.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := loadSettings(path, defaults, 0); got != test.want {
+			t.Errorf("%s: loaded %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	if got := loadSettings(filepath.Join(t.TempDir(), "missing.json"), defaults, 0); got != defaults {
+		t.Errorf("Missing file: loaded %+v, want the defaults", got)
+	}
+}
+
+func TestLoadSettingsInMm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	saved := defaultSettings()
+	saved.SpeedPercentage = 40
+	saved.SpeedMmPerSecond = 100
+	saved.TravelMm = 50
+	if err := saveSettings(path, saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := loadSettings(path, defaultSettings(), 80); s != saved {
+		t.Errorf("Calibrated rig loaded %+v, want %+v", s, saved)
+	}
+
+	// The rest of the saved settings are kept
+	want := saved
+	want.SpeedMmPerSecond = 0
+	want.TravelMm = 0
+	if s := loadSettings(path, defaultSettings(), 0); s != want {
+		t.Errorf("Uncalibrated rig loaded %+v, want %+v", s, want)
+	}
+}
+
+func TestLoadSettingsInMmWithoutPercentages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "settings.json")
+	// The percentage is not checked while the speed in mm/s is set, so it may not be usable on its own
+	if err := ioutil.WriteFile(path, []byte(`{"speedPercentage": 0, "speedMmPerSecond": 100}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s := loadSettings(path, defaultSettings(), 0); s != defaultSettings() {
+		t.Errorf("Loaded %+v, want the defaults", s)
+	}
+}
+
+func TestSetSettingsUncalibrated(t *testing.T) {
+	pg := &PlateGenie{config: DefaultConfig(), settings: defaultSettings()}
+	s := defaultSettings()
+	s.AccelerationMmPerSecond2 = 500
+	if err := pg.SetSettings(s); !errors.Is(err, ErrNotCalibrated) {
+		t.Errorf("Got %v, want ErrNotCalibrated", err)
+	}
+	if pg.Settings() != defaultSettings() {
+		t.Errorf("Settings changed to %+v", pg.Settings())
+	}
+
+	pg.config.Stepper.StepsPerMm = 80
+	if err := pg.SetSettings(s); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,385 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+// Package simulator is a virtual PlateGenie carriage. It provides the stepper, the limit switches, the buttons and
+// the interrupt stream so that the plateGenie package can run without a Raspberry Pi.
+//
+// Positions are in steps. Position 0 is the hard stop on the motor (left) side and Config.RailLength is the hard stop
+// on the right side. StepForward moves the carriage to the right.
+package simulator
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/the-sibyl/plateGenie"
+)
+
+const (
+	// GPIO numbers used for the limit switches when the configuration leaves them at zero. These match app/main.go.
+	defaultLeftLimitGPIO  = 21
+	defaultRightLimitGPIO = 16
+	// Number of events that can be queued on the interrupt stream before a pin change blocks
+	interruptStreamDepth = 64
+)
+
+type Config struct {
+	// Distance in steps between the two hard stops
+	RailLength int
+	// Starting position of the carriage in steps
+	StartPosition int
+
+	// The left switch closes when the position is at or below LeftSwitchZone
+	LeftSwitchZone int
+	// The right switch closes when the position is at or above RailLength - RightSwitchZone
+	RightSwitchZone int
+	// Number of steps that a closed switch has to be cleared by before it opens again
+	Hysteresis int
+
+	// Probability in [0, 1) that a commanded step is lost
+	StepLossProbability float64
+	// Seed for the step loss random number generator
+	Seed int64
+
+	// Value returned by GetPulseDuration(). Each step blocks for this long, like softStepper does. Zero runs as fast
+	// as possible.
+	PulseDuration time.Duration
+
+	LeftLimitGPIO  int
+	RightLimitGPIO int
+}
+
+type Machine struct {
+	mu sync.Mutex
+
+	cfg  Config
+	rand *rand.Rand
+
+	// Actual position of the carriage
+	position int
+	// Steps commanded forward minus steps commanded backward
+	commandedSteps int
+	// Steps lost to step loss or to pushing against a hard stop
+	lostSteps int
+	// Coil hold state
+	hold bool
+
+	interrupts chan plateGenie.Interrupt
+
+	Stepper    *Stepper
+	LeftLimit  *Pin
+	RightLimit *Pin
+}
+
+// Create a new virtual carriage
+func New(cfg Config) *Machine {
+	if cfg.LeftLimitGPIO == 0 {
+		cfg.LeftLimitGPIO = defaultLeftLimitGPIO
+	}
+	if cfg.RightLimitGPIO == 0 {
+		cfg.RightLimitGPIO = defaultRightLimitGPIO
+	}
+
+	m := &Machine{
+		cfg:        cfg,
+		rand:       rand.New(rand.NewSource(cfg.Seed)),
+		position:   cfg.StartPosition,
+		interrupts: make(chan plateGenie.Interrupt, interruptStreamDepth),
+	}
+
+	m.Stepper = &Stepper{m: m}
+	m.LeftLimit = m.NewPin(cfg.LeftLimitGPIO)
+	m.RightLimit = m.NewPin(cfg.RightLimitGPIO)
+
+	// Set the initial switch states without sending any events
+	m.updateSwitches()
+
+	return m
+}
+
+// Create an input pin on the machine, e.g. for a membrane key or a button. The pin starts low.
+func (m *Machine) NewPin(gpioNum int) *Pin {
+	return &Pin{m: m, gpioNum: gpioNum}
+}
+
+// Actual position of the carriage in steps from the left hard stop
+func (m *Machine) Position() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.position
+}
+
+// Move the carriage by hand, e.g. to start a test from a particular position
+func (m *Machine) SetPosition(position int) {
+	m.mu.Lock()
+	m.position = position
+	events := m.updateSwitches()
+	m.mu.Unlock()
+
+	m.send(events)
+}
+
+// Net number of steps commanded by the driver
+func (m *Machine) CommandedSteps() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.commandedSteps
+}
+
+// Number of commanded steps that did not move the carriage
+func (m *Machine) LostSteps() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lostSteps
+}
+
+// Whether the coils are being held
+func (m *Machine) Hold() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hold
+}
+
+func (m *Machine) GetInterruptStream() <-chan plateGenie.Interrupt {
+	return m.interrupts
+}
+
+func (m *Machine) step(direction int) {
+	m.mu.Lock()
+	m.commandedSteps += direction
+	newPosition := m.position + direction
+	if newPosition < 0 || newPosition > m.cfg.RailLength {
+		// Stalled against a hard stop
+		m.lostSteps++
+	} else if m.cfg.StepLossProbability > 0 && m.rand.Float64() < m.cfg.StepLossProbability {
+		m.lostSteps++
+	} else {
+		m.position = newPosition
+	}
+	events := m.updateSwitches()
+	m.mu.Unlock()
+
+	m.send(events)
+
+	if m.cfg.PulseDuration > 0 {
+		time.Sleep(m.cfg.PulseDuration)
+	}
+}
+
+// Recalculate the switch levels from the position. Must be called with the lock held. Returns the events to be sent
+// once the lock is released.
+func (m *Machine) updateSwitches() []plateGenie.Interrupt {
+	var events []plateGenie.Interrupt
+
+	leftLevel := m.LeftLimit.level
+	if m.position <= m.cfg.LeftSwitchZone {
+		leftLevel = 1
+	} else if m.position > m.cfg.LeftSwitchZone+m.cfg.Hysteresis {
+		leftLevel = 0
+	}
+	if e, ok := m.LeftLimit.setLevel(leftLevel); ok {
+		events = append(events, e)
+	}
+
+	rightEdge := m.cfg.RailLength - m.cfg.RightSwitchZone
+	rightLevel := m.RightLimit.level
+	if m.position >= rightEdge {
+		rightLevel = 1
+	} else if m.position < rightEdge-m.cfg.Hysteresis {
+		rightLevel = 0
+	}
+	if e, ok := m.RightLimit.setLevel(rightLevel); ok {
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func (m *Machine) send(events []plateGenie.Interrupt) {
+	for _, e := range events {
+		m.interrupts <- e
+	}
+}
+
+// Virtual stepper driver
+type Stepper struct {
+	m *Machine
+}
+
+func (s *Stepper) StepForward() {
+	s.m.step(1)
+}
+
+func (s *Stepper) StepBackward() {
+	s.m.step(-1)
+}
+
+func (s *Stepper) GetPulseDuration() time.Duration {
+	return s.m.cfg.PulseDuration
+}
+
+func (s *Stepper) EnableHold() {
+	s.m.mu.Lock()
+	s.m.hold = true
+	s.m.mu.Unlock()
+}
+
+func (s *Stepper) DisableHold() {
+	s.m.mu.Lock()
+	s.m.hold = false
+	s.m.mu.Unlock()
+}
+
+// Virtual input pin. Edges are sent on the machine's interrupt stream according to the trigger edge, the same way
+// sysfsGPIO does.
+type Pin struct {
+	m       *Machine
+	gpioNum int
+
+	// The fields below are protected by the machine lock
+	level          int
+	edge           string
+	interruptAdded bool
+	released       bool
+}
+
+func (p *Pin) GPIONum() int {
+	return p.gpioNum
+}
+
+func (p *Pin) Read() (int, error) {
+	p.m.mu.Lock()
+	defer p.m.mu.Unlock()
+	return p.level, nil
+}
+
+func (p *Pin) SetTriggerEdge(edge string) {
+	p.m.mu.Lock()
+	p.edge = edge
+	p.m.mu.Unlock()
+}
+
+// Like sysfsGPIO, adding the interrupt sends one event right away
+func (p *Pin) AddPinInterrupt() {
+	p.m.mu.Lock()
+	p.interruptAdded = true
+	p.m.mu.Unlock()
+
+	p.m.send([]plateGenie.Interrupt{{GPIONum: p.gpioNum}})
+}
+
+func (p *Pin) ReleasePin() {
+	p.m.mu.Lock()
+	p.interruptAdded = false
+	p.released = true
+	p.m.mu.Unlock()
+}
+
+// Whether ReleasePin() has been called
+func (p *Pin) Released() bool {
+	p.m.mu.Lock()
+	defer p.m.mu.Unlock()
+	return p.released
+}
+
+// Drive the pin to a level, e.g. to hold a button down
+func (p *Pin) Set(level int) {
+	p.m.mu.Lock()
+	e, ok := p.setLevel(level)
+	p.m.mu.Unlock()
+
+	if ok {
+		p.m.send([]plateGenie.Interrupt{e})
+	}
+}
+
+// Press and release a button
+func (p *Pin) Press() {
+	p.Set(1)
+	p.Set(0)
+}
+
+// Must be called with the lock held. Returns an event if the change matches the trigger edge.
+func (p *Pin) setLevel(level int) (plateGenie.Interrupt, bool) {
+	if level == p.level {
+		return plateGenie.Interrupt{}, false
+	}
+	p.level = level
+
+	if !p.interruptAdded {
+		return plateGenie.Interrupt{}, false
+	}
+
+	switch p.edge {
+	case "both":
+	case "rising":
+		if level != 1 {
+			return plateGenie.Interrupt{}, false
+		}
+	case "falling":
+		if level != 0 {
+			return plateGenie.Interrupt{}, false
+		}
+	default:
+		return plateGenie.Interrupt{}, false
+	}
+
+	return plateGenie.Interrupt{GPIONum: p.gpioNum}, true
+}
+
+// Virtual 20x4 display that keeps the text on each line, so that a test can pass it to plateGenie.Initialize and
+// check what is showing. The zero value is ready to use.
+type Display struct {
+	mu    sync.Mutex
+	lines [4]string
+}
+
+func (d *Display) ClearDisplay() {
+	d.mu.Lock()
+	d.lines = [4]string{}
+	d.mu.Unlock()
+}
+
+func (d *Display) WriteLine(s string, line int) {
+	if line < 1 || line > len(d.lines) {
+		return
+	}
+	d.mu.Lock()
+	d.lines[line-1] = s
+	d.mu.Unlock()
+}
+
+func (d *Display) WriteLineCentered(s string, line int) {
+	d.WriteLine(s, line)
+}
+
+// Text last written to a line, numbered 1 through 4
+func (d *Display) Line(line int) string {
+	if line < 1 || line > len(d.lines) {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lines[line-1]
+}
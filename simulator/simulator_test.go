@@ -0,0 +1,1215 @@
+package simulator_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/the-sibyl/plateGenie"
+	"github.com/the-sibyl/plateGenie/simulator"
+)
+
+// A known rail for the end-to-end tests
+var rail = simulator.Config{
+	RailLength:      2000,
+	StartPosition:   700,
+	LeftSwitchZone:  10,
+	RightSwitchZone: 10,
+	Hysteresis:      3,
+	PulseDuration:   50 * time.Microsecond,
+}
+
+type rig struct {
+	m        *simulator.Machine
+	pg       *plateGenie.PlateGenie
+	lcd      *simulator.Display
+	k1, k2   *simulator.Pin
+	k3, k4   *simulator.Pin
+	red      *simulator.Pin
+	green    *simulator.Pin
+	cfg      plateGenie.Config
+	stopRun  func()
+	runError chan error
+}
+
+// Start a PlateGenie on a simulated machine with the default pin mapping, running until the test ends
+func newRig(t *testing.T, simCfg simulator.Config) *rig {
+	t.Helper()
+	return newRigConfig(t, simCfg, plateGenie.DefaultConfig())
+}
+
+// Same as newRig, starting from the given configuration
+func newRigConfig(t *testing.T, simCfg simulator.Config, cfg plateGenie.Config) *rig {
+	t.Helper()
+	cfg.DebounceMicroseconds = 200
+	cfg.Homing.StepDelayMicroseconds = 0
+
+	m := simulator.New(simCfg)
+	p := cfg.Pins
+	r := &rig{m: m, lcd: &simulator.Display{}, cfg: cfg,
+		k1: m.NewPin(p.Membrane[0]), k2: m.NewPin(p.Membrane[1]), k3: m.NewPin(p.Membrane[2]),
+		k4: m.NewPin(p.Membrane[3]), red: m.NewPin(p.RedButton), green: m.NewPin(p.GreenButton)}
+
+	pg, err := plateGenie.Initialize(&cfg, r.lcd, r.k1, r.k2, r.k3, r.k4, r.red, r.green, m.LeftLimit, m.RightLimit,
+		m, m.Stepper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.pg = pg
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopRun = cancel
+	r.runError = make(chan error, 1)
+	go func() { r.runError <- pg.Run(ctx) }()
+	t.Cleanup(func() {
+		r.stopRun()
+		<-r.runError
+		pg.Close()
+	})
+
+	if err := pg.ResetEStop(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// Press a key and give the menu time to take it
+func (r *rig) press(p *simulator.Pin) {
+	p.Press()
+	time.Sleep(100 * time.Millisecond)
+}
+
+func (r *rig) waitState(t *testing.T, want plateGenie.MachineState) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if s, _ := r.pg.State(); s == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s, reason := r.pg.State()
+	t.Fatalf("State is %v (%s), want %v", s, reason, want)
+}
+
+// Wait for the agitation cycle to finish by itself
+func (r *rig) waitCycleEnd(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := r.pg.AgitationStatus(); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Agitation cycle still running")
+}
+
+// Wait for the nth run to be added to the history and return it
+func (r *rig) waitRun(t *testing.T, n int) plateGenie.RunRecord {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for time.Now().Before(deadline) {
+		if h := r.pg.History(); len(h) >= n {
+			return h[n-1]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Run %d never ended", n)
+	return plateGenie.RunRecord{}
+}
+
+// Where the carriage has to be on the rail after homing. Homing counts the steps with both switches open while
+// moving right from the left switch, which opens Hysteresis+1 steps past its zone, up to the right switch closing
+// at RailLength-RightSwitchZone. The backoff is taken off both ends and the carriage is parked half way.
+func homedEnds(simCfg simulator.Config, backoff int) (int, int) {
+	left := simCfg.LeftSwitchZone + simCfg.Hysteresis + 1 + backoff
+	right := simCfg.RailLength - simCfg.RightSwitchZone - backoff
+	return left, right
+}
+
+func TestHomeBoth(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+	left, right := homedEnds(rail, r.cfg.Homing.BackoffSteps)
+	travel := r.pg.TravelSteps()
+	if travel != right-left {
+		t.Fatalf("TravelSteps() = %d, want %d", travel, right-left)
+	}
+	if got := r.pg.Position(); got != travel/2 {
+		t.Errorf("Position() after homing = %d, want %d", got, travel/2)
+	}
+	if got := r.m.Position(); got != right-travel+travel/2 {
+		t.Errorf("Carriage at %d after homing, want %d", got, right-travel+travel/2)
+	}
+
+	if err := r.pg.MoveTo(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.m.Position(); got != left {
+		t.Errorf("MoveTo(0) left the carriage at %d, want %d", got, left)
+	}
+	if level, _ := r.m.LeftLimit.Read(); level != 0 {
+		t.Error("Left switch is closed at position 0")
+	}
+
+	if err := r.pg.MoveTo(ctx, travel); err != nil {
+		t.Fatal(err)
+	}
+	if got := r.m.Position(); got != right {
+		t.Errorf("MoveTo(%d) left the carriage at %d, want %d", travel, got, right)
+	}
+	if level, _ := r.m.RightLimit.Read(); level != 0 {
+		t.Error("Right switch is closed at the end of the travel")
+	}
+
+	if lost := r.m.LostSteps(); lost != 0 {
+		t.Errorf("%d steps lost", lost)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateIdle {
+		t.Errorf("State is %v, want Idle", s)
+	}
+}
+
+func TestTrapezoidalMove(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, steps := range []int{1, 7, 250, -600, 342} {
+		before, commanded := r.m.Position(), r.m.CommandedSteps()
+		position := r.pg.Position()
+		if err := r.pg.MoveBy(ctx, steps); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.m.Position() - before; got != steps {
+			t.Errorf("MoveBy(%d) moved the carriage %d steps", steps, got)
+		}
+		if got := r.m.CommandedSteps() - commanded; got != steps {
+			t.Errorf("MoveBy(%d) commanded %d steps", steps, got)
+		}
+		if got := r.pg.Position() - position; got != steps {
+			t.Errorf("MoveBy(%d) changed Position() by %d", steps, got)
+		}
+	}
+}
+
+func TestPlanMove(t *testing.T) {
+	r := newRig(t, rail)
+	s := r.pg.Settings()
+	s.Profile = plateGenie.ProfileTrapezoidal
+	s.SpeedPercentage = 50
+	s.ConstantSpeedPercentage = 60
+
+	tl, err := r.pg.PlanMove(-1000, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tl.Forward || len(tl.Steps) != 1000 || tl.Ramp != 125 || tl.Decel != 875 {
+		t.Errorf("Planned %d steps, forward %v, ramp %d and deceleration from %d", len(tl.Steps), tl.Forward,
+			tl.Ramp, tl.Decel)
+	}
+	if tl.Duration != 118750*time.Microsecond {
+		t.Errorf("Duration %v", tl.Duration)
+	}
+	if err := tl.Check(rail.PulseDuration); err != nil {
+		t.Error(err)
+	}
+	if r.m.CommandedSteps() != 0 {
+		t.Errorf("Planning moved the stepper %d steps", r.m.CommandedSteps())
+	}
+
+	s.SpeedPercentage = 0
+	if _, err := r.pg.PlanMove(100, s); !errors.Is(err, plateGenie.ErrOutOfRange) {
+		t.Errorf("Speed 0: got %v, want ErrOutOfRange", err)
+	}
+}
+
+func TestPlanMoveProfiles(t *testing.T) {
+	r := newRig(t, rail)
+	s := r.pg.Settings()
+	s.SpeedPercentage = 2
+	s.ConstantSpeedPercentage = 60
+	// 2% of the stepper's 20000 steps per second, slow enough for the S-curve to get there at its acceleration
+	want := 50 * rail.PulseDuration
+
+	for _, profile := range []plateGenie.Profile{plateGenie.ProfileTrapezoidal, plateGenie.ProfileSinusoidal,
+		plateGenie.ProfileSCurve} {
+		s.Profile = profile
+		tl, err := r.pg.PlanMove(4000, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fastest := tl.Duration
+		for k := 1; k < len(tl.Steps); k++ {
+			if d := tl.Steps[k] - tl.Steps[k-1]; d < fastest {
+				fastest = d
+			}
+		}
+		if fastest < want*99/100 || fastest > want*101/100 {
+			t.Errorf("%s: fastest step takes %v, want %v", profile, fastest, want)
+		}
+	}
+}
+
+func TestHomeSingle(t *testing.T) {
+	r := newRig(t, rail)
+	backoff := r.cfg.Homing.BackoffSteps
+
+	// Menu item 2 is Home Single
+	r.press(r.k4)
+
+	r.press(r.k2)
+	r.waitState(t, plateGenie.StateUnhomed)
+	time.Sleep(100 * time.Millisecond)
+	r.waitState(t, plateGenie.StateUnhomed)
+	if got, want := r.m.Position(), rail.LeftSwitchZone+backoff; got != want {
+		t.Errorf("Home left parked the carriage at %d, want %d", got, want)
+	}
+
+	r.press(r.k3)
+	deadline := time.Now().Add(30 * time.Second)
+	want := rail.RailLength - rail.RightSwitchZone - backoff
+	for r.m.Position() != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.waitState(t, plateGenie.StateUnhomed)
+	if got := r.m.Position(); got != want {
+		t.Errorf("Home right parked the carriage at %d, want %d", got, want)
+	}
+	if r.pg.TravelSteps() != 0 {
+		t.Errorf("TravelSteps() = %d after homing a single switch", r.pg.TravelSteps())
+	}
+}
+
+func TestStepLoss(t *testing.T) {
+	lossy := rail
+	lossy.StepLossProbability = 0.05
+	lossy.Seed = 1
+	r := newRig(t, lossy)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	before, lost := r.m.Position(), r.m.LostSteps()
+	position := r.pg.Position()
+	if err := r.pg.MoveBy(ctx, 500); err != nil {
+		t.Fatal(err)
+	}
+	lost = r.m.LostSteps() - lost
+	if lost == 0 {
+		t.Fatal("No steps lost")
+	}
+	// The position is open loop, so it counts every commanded step while the carriage falls short by the lost ones
+	if got := r.pg.Position() - position; got != 500 {
+		t.Errorf("Position() moved %d, want 500", got)
+	}
+	if got := r.m.Position() - before; got != 500-lost {
+		t.Errorf("Carriage moved %d with %d steps lost, want %d", got, lost, 500-lost)
+	}
+}
+
+func TestSwitchFault(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	commanded := r.m.CommandedSteps()
+	done := make(chan error)
+	go func() { done <- r.pg.MoveBy(ctx, -600) }()
+
+	// Knock the carriage onto the left switch behind the controller's back part way through the move
+	time.Sleep(50 * time.Millisecond)
+	r.m.SetPosition(rail.LeftSwitchZone / 2)
+	if err := <-done; !errors.Is(err, plateGenie.ErrFaulted) {
+		t.Fatalf("Move returned %v, want %v", err, plateGenie.ErrFaulted)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateFaulted {
+		t.Errorf("State is %v, want Faulted", s)
+	}
+	if got := commanded - r.m.CommandedSteps(); got >= 600 {
+		t.Errorf("Move carried on for all %d steps after the fault", got)
+	}
+}
+
+func TestCancelRampsDown(t *testing.T) {
+	r := newRig(t, rail)
+	if err := r.pg.Home(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pg.MoveTo(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	s := r.pg.Settings()
+	s.SpeedPercentage = 10
+	s.ConstantSpeedPercentage = 20
+	if err := r.pg.SetSettings(s); err != nil {
+		t.Fatal(err)
+	}
+
+	start := r.m.Position()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.pg.MoveBy(ctx, 1200) }()
+
+	// Part way up the 400 step ramp
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	atCancel := r.m.Position() - start
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Move returned %v, want %v", err, context.Canceled)
+	}
+	moved := r.m.Position() - start
+	if moved-atCancel < 10 {
+		t.Errorf("Carriage stopped %d steps after the cancel, want it to slow down", moved-atCancel)
+	}
+	if moved >= 1200 {
+		t.Errorf("Move finished %d steps after being cancelled", moved-atCancel)
+	}
+	if r.pg.Position() != moved {
+		t.Errorf("Position() is %d, want %d", r.pg.Position(), moved)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateIdle {
+		t.Errorf("State is %v, want Idle", s)
+	}
+}
+
+func TestEStopDuringHoming(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- r.pg.Home(ctx) }()
+	r.waitState(t, plateGenie.StateHoming)
+	time.Sleep(20 * time.Millisecond)
+	r.pg.EStop()
+	if err := <-done; !errors.Is(err, plateGenie.ErrEStopped) {
+		t.Fatalf("Home returned %v, want %v", err, plateGenie.ErrEStopped)
+	}
+
+	// The homing steps were not counted, so the position from the first homing is stale
+	if err := r.pg.ResetEStop(); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateUnhomed {
+		t.Errorf("State after reset is %v, want Unhomed", s)
+	}
+	if err := r.pg.MoveTo(ctx, 0); !errors.Is(err, plateGenie.ErrNotHomed) {
+		t.Errorf("MoveTo returned %v, want %v", err, plateGenie.ErrNotHomed)
+	}
+}
+
+// Home, park at the left end and slow down to 1000 steps per second, so that moves can be stopped part way through
+func (r *rig) homeSlow(t *testing.T) {
+	t.Helper()
+	if err := r.pg.Home(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pg.MoveTo(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	s := r.pg.Settings()
+	s.SpeedPercentage = 5
+	s.ConstantSpeedPercentage = 60
+	if err := r.pg.SetSettings(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Start a two segment program from the left end, slow enough to be stopped part way through the second segment
+func (r *rig) startProgram(t *testing.T, ctx context.Context) (int, chan error) {
+	t.Helper()
+	r.homeSlow(t)
+
+	travel := r.pg.TravelSteps()
+	done := make(chan error, 1)
+	go func() {
+		done <- r.pg.RunProgram(ctx, []plateGenie.Segment{{Steps: 100}, {Steps: travel - 100}})
+	}()
+	// Well into the second segment at 1000 steps per second
+	time.Sleep(600 * time.Millisecond)
+	if p := r.pg.Position(); p <= 100 {
+		t.Fatalf("Still in the first segment at %d", p)
+	}
+	return travel, done
+}
+
+func TestCancelProgram(t *testing.T) {
+	r := newRig(t, rail)
+	ctx, cancel := context.WithCancel(context.Background())
+	travel, done := r.startProgram(t, ctx)
+
+	cancel()
+	atCancel := r.pg.Position()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("RunProgram returned %v, want %v", err, context.Canceled)
+	}
+	stopped := r.pg.Position()
+	if stopped-atCancel < 10 || stopped >= travel {
+		t.Errorf("Cancelled at %d and stopped at %d of %d, want it to slow down and stop short", atCancel, stopped,
+			travel)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateIdle {
+		t.Errorf("State is %v, want Idle", s)
+	}
+}
+
+func TestHoldProgram(t *testing.T) {
+	r := newRig(t, rail)
+	travel, done := r.startProgram(t, context.Background())
+
+	if err := r.pg.FeedHold(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	held := r.pg.Position()
+	time.Sleep(200 * time.Millisecond)
+	if p := r.pg.Position(); p != held || p >= travel {
+		t.Fatalf("Carriage at %d and then %d of %d during the hold", held, p, travel)
+	}
+
+	if err := r.pg.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if p := r.pg.Position(); p != travel {
+		t.Errorf("Program ended at %d, want %d", p, travel)
+	}
+}
+
+// The executor is started by Initialize, so Close has to stop it even if Run never started
+func TestCloseWithoutRun(t *testing.T) {
+	cfg := plateGenie.DefaultConfig()
+	m := simulator.New(rail)
+	p := cfg.Pins
+	pins := []*simulator.Pin{m.NewPin(p.Membrane[0]), m.NewPin(p.Membrane[1]), m.NewPin(p.Membrane[2]),
+		m.NewPin(p.Membrane[3]), m.NewPin(p.RedButton), m.NewPin(p.GreenButton)}
+	pg, err := plateGenie.Initialize(&cfg, &simulator.Display{}, pins[0], pins[1], pins[2], pins[3], pins[4], pins[5],
+		m.LeftLimit, m.RightLimit, m, m.Stepper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- pg.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+
+	for _, pin := range append(pins, m.LeftLimit, m.RightLimit) {
+		if !pin.Released() {
+			t.Errorf("Pin %d not released", pin.GPIONum())
+		}
+	}
+	if m.Hold() {
+		t.Error("Coils still energized")
+	}
+}
+
+func TestHoldScreen(t *testing.T) {
+	r := newRig(t, rail)
+	_, done := r.startProgram(t, context.Background())
+	menuLine := r.lcd.Line(1)
+
+	if err := r.pg.FeedHold(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if l := r.lcd.Line(2); l != "Feed hold" {
+		t.Fatalf("Line 2 is %q during the hold", l)
+	}
+	// The menu stays underneath until the hold ends
+	r.press(r.k4)
+	if l := r.lcd.Line(2); l != "Feed hold" {
+		t.Errorf("Line 2 is %q after a key press during the hold", l)
+	}
+
+	if err := r.pg.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if l := r.lcd.Line(1); l != menuLine {
+		t.Errorf("Line 1 is %q after the hold, want %q", l, menuLine)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+
+	if err := r.pg.MoveTo(ctx, 5); !errors.Is(err, plateGenie.ErrNotHomed) {
+		t.Errorf("MoveTo before homing returned %v, want %v", err, plateGenie.ErrNotHomed)
+	}
+	if err := r.pg.StopAgitation(ctx); !errors.Is(err, plateGenie.ErrNotAgitating) {
+		t.Errorf("StopAgitation returned %v, want %v", err, plateGenie.ErrNotAgitating)
+	}
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var rangeErr *plateGenie.RangeError
+	if err := r.pg.MoveTo(ctx, r.pg.TravelSteps()+1); !errors.As(err, &rangeErr) ||
+		!errors.Is(err, plateGenie.ErrOutOfRange) {
+		t.Errorf("MoveTo past the end returned %v, want a RangeError", err)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateIdle {
+		t.Errorf("State after a rejected move is %v, want Idle", s)
+	}
+	if err := r.pg.MoveTo(ctx, 100); err != nil || r.pg.Position() != 100 {
+		t.Fatalf("MoveTo(100) returned %v at %d", err, r.pg.Position())
+	}
+	if err := r.pg.MoveBy(ctx, -30); err != nil || r.pg.Position() != 70 {
+		t.Fatalf("MoveBy(-30) returned %v at %d", err, r.pg.Position())
+	}
+
+	if err := r.pg.StartAgitation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var stateErr *plateGenie.StateError
+	if err := r.pg.MoveBy(ctx, 1); !errors.As(err, &stateErr) || !errors.Is(err, plateGenie.ErrBusy) {
+		t.Errorf("MoveBy while agitating returned %v, want ErrBusy", err)
+	} else if stateErr.State != plateGenie.StateAgitating {
+		t.Errorf("StateError has state %v, want Agitating", stateErr.State)
+	}
+	if err := r.pg.StopAgitation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateIdle {
+		t.Errorf("State after stopping the agitation is %v, want Idle", s)
+	}
+
+	// An emergency stop ends the cycle by itself
+	if err := r.pg.StartAgitation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.pg.EStop()
+	r.waitCycleEnd(t)
+	if err := r.pg.StopAgitation(ctx); !errors.Is(err, plateGenie.ErrNotAgitating) {
+		t.Errorf("StopAgitation after an emergency stop returned %v, want %v", err, plateGenie.ErrNotAgitating)
+	}
+	if err := r.pg.MoveBy(ctx, 1); !errors.Is(err, plateGenie.ErrEStopped) {
+		t.Errorf("MoveBy after an emergency stop returned %v, want %v", err, plateGenie.ErrEStopped)
+	}
+}
+
+func TestCancelHoming(t *testing.T) {
+	r := newRig(t, rail)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- r.pg.Home(ctx) }()
+	r.waitState(t, plateGenie.StateHoming)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Home returned %v, want %v", err, context.Canceled)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateUnhomed {
+		t.Errorf("State is %v, want Unhomed", s)
+	}
+
+	// Not an emergency stop, so homing can start again straight away
+	if err := r.pg.Home(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelAgitation(t *testing.T) {
+	r := newRig(t, rail)
+	if err := r.pg.Home(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := r.pg.StartAgitation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+	r.waitCycleEnd(t)
+	if s, _ := r.pg.State(); s != plateGenie.StateIdle {
+		t.Errorf("State is %v, want Idle", s)
+	}
+	if lost := r.m.LostSteps(); lost != 0 {
+		t.Errorf("%d steps lost", lost)
+	}
+
+	// The position is still good enough to reach both ends
+	if err := r.pg.MoveTo(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	left, _ := homedEnds(rail, r.cfg.Homing.BackoffSteps)
+	if got := r.m.Position(); got != left {
+		t.Errorf("MoveTo(0) after the cancel left the carriage at %d, want %d", got, left)
+	}
+}
+
+func TestFeedHoldAbort(t *testing.T) {
+	r := newRig(t, rail)
+	if err := r.pg.FeedHold(); !errors.Is(err, plateGenie.ErrNotHomed) {
+		t.Errorf("FeedHold at rest returned %v, want %v", err, plateGenie.ErrNotHomed)
+	}
+	r.homeSlow(t)
+
+	travel := r.pg.TravelSteps()
+	done := make(chan error)
+	go func() { done <- r.pg.MoveTo(context.Background(), travel) }()
+	time.Sleep(300 * time.Millisecond)
+	if err := r.pg.FeedHold(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if err := r.pg.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; !errors.Is(err, plateGenie.ErrMoveAborted) {
+		t.Fatalf("MoveTo returned %v, want %v", err, plateGenie.ErrMoveAborted)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateIdle {
+		t.Errorf("State is %v, want Idle", s)
+	}
+	if err := r.pg.Resume(); !errors.Is(err, plateGenie.ErrNotHeld) {
+		t.Errorf("Resume after the abort returned %v, want %v", err, plateGenie.ErrNotHeld)
+	}
+
+	// The position is kept through the hold
+	left, _ := homedEnds(rail, r.cfg.Homing.BackoffSteps)
+	if p := r.pg.Position(); p <= 0 || p >= travel || r.m.Position() != left+p {
+		t.Errorf("Aborted at %d with the carriage at %d", p, r.m.Position())
+	}
+}
+
+func TestFeedHoldAgitation(t *testing.T) {
+	r := newRig(t, rail)
+	r.homeSlow(t)
+	if err := r.pg.StartAgitation(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	// The green button holds and resumes
+	r.press(r.green)
+	if !r.pg.FeedHoldActive() {
+		t.Fatal("Green button did not hold the stroke")
+	}
+	time.Sleep(400 * time.Millisecond)
+	held := r.m.Position()
+	time.Sleep(200 * time.Millisecond)
+	if p := r.m.Position(); p != held {
+		t.Fatalf("Carriage moved from %d to %d during the hold", held, p)
+	}
+	r.press(r.green)
+	if r.pg.FeedHoldActive() {
+		t.Fatal("Green button did not resume")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if p := r.m.Position(); p == held {
+		t.Error("Carriage did not move after resuming")
+	}
+
+	// Stopping the cycle during a hold aborts the held stroke
+	if err := r.pg.FeedHold(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if err := r.pg.StopAgitation(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s, _ := r.pg.State(); s != plateGenie.StateIdle {
+		t.Errorf("State is %v, want Idle", s)
+	}
+}
+
+func TestTimedAgitation(t *testing.T) {
+	r := newRig(t, rail)
+	if err := r.pg.Home(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pg.MoveTo(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+	s := r.pg.Settings()
+	s.AgitationSeconds = 2
+	if err := r.pg.SetSettings(s); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := r.pg.StartAgitation(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if remaining, ok := r.pg.AgitationRemaining(); !ok || remaining < time.Second || remaining > 2*time.Second {
+		t.Errorf("AgitationRemaining() = %v, %v at the start", remaining, ok)
+	}
+	r.waitCycleEnd(t)
+	r.waitState(t, plateGenie.StateIdle)
+	if elapsed := time.Since(start); elapsed < 2*time.Second || elapsed > 5*time.Second {
+		t.Errorf("Cycle took %v, want 2s and the last stroke", elapsed)
+	}
+	if p := r.pg.Position(); p != r.pg.TravelSteps()/2 {
+		t.Errorf("Cycle ended at %d, want the centre at %d", p, r.pg.TravelSteps()/2)
+	}
+	if _, ok := r.pg.AgitationRemaining(); ok {
+		t.Error("AgitationRemaining() still reports a cycle")
+	}
+}
+
+func TestRunRecipe(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := plateGenie.Recipe{Name: "Bad", Phases: []plateGenie.Phase{{Name: "Develop", Seconds: 1,
+		ConstantSpeedPercentage: 50, TravelPercentage: 50, Pattern: plateGenie.PatternContinuous}}}
+	if err := r.pg.RunRecipe(ctx, bad); !errors.Is(err, plateGenie.ErrInvalidRecipe) ||
+		!errors.Is(err, plateGenie.ErrOutOfRange) {
+		t.Errorf("Invalid recipe: got %v", err)
+	}
+
+	recipe := plateGenie.Recipe{Name: "C41", Phases: []plateGenie.Phase{
+		{Name: "Develop", Seconds: 2, SpeedPercentage: 50, ConstantSpeedPercentage: 50, TravelPercentage: 30,
+			Pattern: plateGenie.PatternContinuous},
+		{Name: "Blix", Seconds: 1, SpeedPercentage: 20, ConstantSpeedPercentage: 50, TravelPercentage: 60,
+			Pattern: plateGenie.PatternContinuous},
+	}}
+	if err := r.pg.RunRecipe(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+	phases := make(map[string]int)
+	for {
+		status, ok := r.pg.AgitationStatus()
+		if !ok {
+			break
+		}
+		if status.Recipe != "C41" || status.PhaseCount != 2 {
+			t.Fatalf("Status %+v", status)
+		}
+		phases[status.Phase] = status.PhaseNumber
+		time.Sleep(20 * time.Millisecond)
+	}
+	if phases["Develop"] != 1 || phases["Blix"] != 2 {
+		t.Errorf("Phases seen: %v", phases)
+	}
+
+	run := r.waitRun(t, 1)
+	if run.Recipe != "C41" || run.Result != plateGenie.RunComplete || run.Strokes == 0 {
+		t.Errorf("Run recorded as %+v", run)
+	}
+	if d := run.End.Sub(run.Start); d < 3*time.Second {
+		t.Errorf("Recipe took %v, want at least 3s", d)
+	}
+	r.waitState(t, plateGenie.StateIdle)
+	if p := r.pg.Position(); p != r.pg.TravelSteps()/2 {
+		t.Errorf("Recipe ended at %d, want the centre at %d", p, r.pg.TravelSteps()/2)
+	}
+}
+
+func TestRecipeEditor(t *testing.T) {
+	cfg := plateGenie.DefaultConfig()
+	cfg.RecipeDir = t.TempDir()
+	r := newRigConfig(t, rail, cfg)
+
+	// Recipe Editor is three items back from Home Both
+	for k := 0; k < 3; k++ {
+		r.press(r.k1)
+	}
+	r.press(r.k2)
+	if l := r.lcd.Line(2); l != "New recipe" {
+		t.Fatalf("Line 2 is %q on opening the editor", l)
+	}
+	// New recipe, Phases, the first phase, Edit
+	for k := 0; k < 4; k++ {
+		r.press(r.k2)
+	}
+	if l := r.lcd.Line(2); l != "Name" {
+		t.Fatalf("Line 2 is %q in the list of fields", l)
+	}
+
+	// Time from 01:00 to 11:00
+	r.press(r.k4)
+	r.press(r.k2)
+	r.press(r.k2)
+	r.press(r.k3)
+	recipes, errs := plateGenie.LoadRecipes(cfg.RecipeDir)
+	if len(errs) != 0 || len(recipes) != 1 {
+		t.Fatalf("Loaded %+v with errors %v", recipes, errs)
+	}
+	if recipes[0].Name != "NEW RECIPE" || recipes[0].Phases[0].Seconds != 660 {
+		t.Errorf("Saved %+v", recipes[0])
+	}
+	if loaded := r.pg.Recipes(); len(loaded) != 1 || loaded[0].Phases[0].Seconds != 660 {
+		t.Errorf("Recipes() = %+v after saving", loaded)
+	}
+
+	// Speed from 080 to 180 is refused and not saved
+	r.press(r.k4)
+	r.press(r.k4)
+	r.press(r.k2)
+	r.press(r.k2)
+	r.press(r.k3)
+	if l := r.lcd.Line(3); l != "Use 1 to 100" {
+		t.Errorf("Line 3 is %q after entering 180%%", l)
+	}
+	if recipes, _ := plateGenie.LoadRecipes(cfg.RecipeDir); recipes[0].Phases[0].SpeedPercentage != 80 {
+		t.Errorf("Saved a speed of %d%%", recipes[0].Phases[0].SpeedPercentage)
+	}
+}
+
+func TestIntervalRest(t *testing.T) {
+	r := newRig(t, rail)
+	if err := r.pg.Home(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Stepper Hold is item 6
+	for k := 0; k < 5; k++ {
+		r.press(r.k4)
+	}
+	r.press(r.k2)
+	if !r.m.Hold() {
+		t.Fatal("Stepper Hold did not energize the coils")
+	}
+
+	for _, interval := range []int{2, 0} {
+		recipe := plateGenie.Recipe{Name: "Stand", Phases: []plateGenie.Phase{{Name: "Develop", Seconds: 5,
+			SpeedPercentage: 50, ConstantSpeedPercentage: 50, TravelPercentage: 20, Pattern: plateGenie.PatternInterval,
+			AgitateSeconds: 1, IntervalSeconds: interval, ReleaseCoils: true}}}
+		start := time.Now()
+		if err := r.pg.RunRecipe(context.Background(), recipe); err != nil {
+			t.Fatal(err)
+		}
+
+		rests, released := 0, 0
+		resting, releasedThisRest := false, false
+		for {
+			status, ok := r.pg.AgitationStatus()
+			if !ok {
+				break
+			}
+			if status.Resting {
+				if !resting {
+					rests++
+					releasedThisRest = false
+				}
+				if !r.m.Hold() && !releasedThisRest {
+					released++
+					releasedThisRest = true
+				}
+				if p := r.pg.Position(); p != r.pg.TravelSteps()/2 {
+					t.Fatalf("Interval %ds: resting at %d, want the centre", interval, p)
+				}
+			}
+			resting = status.Resting
+			time.Sleep(10 * time.Millisecond)
+		}
+		r.waitState(t, plateGenie.StateIdle)
+
+		// Bursts at 0s, 2s and 4s, or a single burst
+		want := 2
+		if interval == 0 {
+			want = 1
+		}
+		if rests != want || released != rests {
+			t.Errorf("Interval %ds: %d rests with the coils released in %d, want %d", interval, rests, released,
+				want)
+		}
+		if elapsed := time.Since(start); elapsed < 5*time.Second || elapsed > 8*time.Second {
+			t.Errorf("Interval %ds: phase took %v, want 5s", interval, elapsed)
+		}
+		if !r.m.Hold() {
+			t.Errorf("Interval %ds: coils left released after the phase", interval)
+		}
+	}
+}
+
+func TestStrokeLimit(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s := r.pg.Settings()
+	s.AgitationStrokes = 3
+	if err := r.pg.SetSettings(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.pg.StartAgitation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if status, ok := r.pg.AgitationStatus(); !ok || status.StrokeLimit != 3 || status.Timed {
+		t.Errorf("Status %+v at the start", status)
+	}
+	run := r.waitRun(t, 1)
+	if run.Strokes != 3 || run.Result != plateGenie.RunComplete {
+		t.Errorf("Run recorded as %+v", run)
+	}
+	r.waitState(t, plateGenie.StateIdle)
+	if p := r.pg.Position(); p != r.pg.TravelSteps()/2 {
+		t.Errorf("Cycle ended at %d, want the centre at %d", p, r.pg.TravelSteps()/2)
+	}
+
+	// Each phase counts its own strokes
+	phase := plateGenie.Phase{Name: "Develop", SpeedPercentage: 50, ConstantSpeedPercentage: 50,
+		TravelPercentage: 50, Pattern: plateGenie.PatternContinuous}
+	recipe := plateGenie.Recipe{Name: "Strokes", Phases: []plateGenie.Phase{phase, phase}}
+	recipe.Phases[0].Strokes = 2
+	recipe.Phases[1].Strokes = 4
+	if err := r.pg.RunRecipe(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+	run = r.waitRun(t, 2)
+	if run.Strokes != 6 || run.Recipe != "Strokes" || run.Result != plateGenie.RunComplete {
+		t.Errorf("Recipe recorded as %+v", run)
+	}
+}
+
+func TestDwell(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Four strokes with and without a dwell after each of the first three
+	var durations []time.Duration
+	for k, dwell := range []int{0, 500} {
+		s := r.pg.Settings()
+		s.AgitationStrokes = 4
+		s.DwellMilliseconds = dwell
+		if err := r.pg.SetSettings(s); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.pg.StartAgitation(ctx); err != nil {
+			t.Fatal(err)
+		}
+		run := r.waitRun(t, k+1)
+		if run.Strokes != 4 {
+			t.Fatalf("Dwell %dms: %d strokes", dwell, run.Strokes)
+		}
+		durations = append(durations, run.End.Sub(run.Start))
+		r.waitState(t, plateGenie.StateIdle)
+	}
+	if extra := durations[1] - durations[0]; extra < 1400*time.Millisecond || extra > 2500*time.Millisecond {
+		t.Errorf("Dwells added %v, want 1.5s", extra)
+	}
+
+	// The end of a timed cycle cuts the dwell short
+	s := r.pg.Settings()
+	s.AgitationStrokes = 0
+	s.AgitationSeconds = 1
+	// The longest dwell there is
+	s.DwellMilliseconds = 5000
+	if err := r.pg.SetSettings(s); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.pg.StartAgitation(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if run := r.waitRun(t, 3); run.End.Sub(run.Start) > 3*time.Second {
+		t.Errorf("1s cycle with a %dms dwell took %v", s.DwellMilliseconds, run.End.Sub(run.Start))
+	}
+}
+
+func TestRandomSeed(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recipe := plateGenie.Recipe{Name: "Random", Phases: []plateGenie.Phase{{Name: "Develop", Strokes: 4,
+		SpeedPercentage: 90, ConstantSpeedPercentage: 50, TravelPercentage: 80, Pattern: plateGenie.PatternRandom,
+		MinSpeedPercentage: 40, MinTravelPercentage: 20}}}
+
+	if err := r.pg.RunRecipe(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+	first := r.waitRun(t, 1)
+	if first.Seed == 0 || first.Strokes != 4 || first.Result != plateGenie.RunComplete {
+		t.Fatalf("Run recorded as %+v", first)
+	}
+	r.waitState(t, plateGenie.StateIdle)
+
+	// The seed from the history runs it again
+	if err := r.pg.RunRecipeWithSeed(ctx, recipe, first.Seed); err != nil {
+		t.Fatal(err)
+	}
+	if again := r.waitRun(t, 2); again.Seed != first.Seed || again.Strokes != 4 {
+		t.Errorf("Run again recorded as %+v", again)
+	}
+}
+
+func TestSinusoidalRecipe(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+	recipe := plateGenie.Recipe{Name: "Smooth", Phases: []plateGenie.Phase{{Name: "Develop", Strokes: 4,
+		SpeedPercentage: 10, TravelPercentage: 80, Profile: plateGenie.ProfileSinusoidal,
+		Pattern: plateGenie.PatternContinuous}}}
+	if err := r.pg.RunRecipe(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+
+	// A hold part way through a stroke slows down along the curve and picks up again
+	time.Sleep(500 * time.Millisecond)
+	if err := r.pg.FeedHold(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	held := r.m.Position()
+	time.Sleep(200 * time.Millisecond)
+	if p := r.m.Position(); p != held {
+		t.Fatalf("Carriage moved from %d to %d during the hold", held, p)
+	}
+	if err := r.pg.Resume(); err != nil {
+		t.Fatal(err)
+	}
+
+	if run := r.waitRun(t, 1); run.Strokes != 4 || run.Result != plateGenie.RunComplete {
+		t.Errorf("Run recorded as %+v", run)
+	}
+	r.waitState(t, plateGenie.StateIdle)
+	if p := r.pg.Position(); p != r.pg.TravelSteps()/2 {
+		t.Errorf("Recipe ended at %d, want the centre at %d", p, r.pg.TravelSteps()/2)
+	}
+	if lost := r.m.LostSteps(); lost != 0 {
+		t.Errorf("%d steps lost", lost)
+	}
+}
+
+func TestMovesInMm(t *testing.T) {
+	cfg := plateGenie.DefaultConfig()
+	cfg.Stepper.StepsPerMm = 10
+	r := newRigConfig(t, rail, cfg)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.pg.MoveToMm(ctx, 12.34); err != nil {
+		t.Fatal(err)
+	}
+	if mm, err := r.pg.PositionMm(); err != nil || mm != 12.3 || r.pg.Position() != 123 {
+		t.Errorf("PositionMm() = %v, %v at step %d", mm, err, r.pg.Position())
+	}
+	if err := r.pg.MoveByMm(ctx, -2.3); err != nil || r.pg.Position() != 100 {
+		t.Errorf("MoveByMm(-2.3) returned %v at step %d", err, r.pg.Position())
+	}
+
+	recipe := plateGenie.Recipe{Name: "Shared", Phases: []plateGenie.Phase{
+		{Name: "Develop", Strokes: 2, SpeedMmPerSecond: 150, AccelerationMmPerSecond2: 3000, TravelMm: 60,
+			Pattern: plateGenie.PatternContinuous},
+		{Name: "Fix", Strokes: 2, SpeedMmPerSecond: 150, ConstantSpeedPercentage: 60, TravelMm: 60,
+			MinSpeedMmPerSecond: 50, MinTravelMm: 20, Pattern: plateGenie.PatternRandom},
+	}}
+	if err := r.pg.RunRecipe(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+	if run := r.waitRun(t, 1); run.Strokes != 4 || run.Result != plateGenie.RunComplete {
+		t.Errorf("Run recorded as %+v", run)
+	}
+
+	// Longer than the rail
+	recipe.Phases = recipe.Phases[:1]
+	recipe.Phases[0].TravelMm = 500
+	r.waitState(t, plateGenie.StateIdle)
+	if err := r.pg.RunRecipe(ctx, recipe); err != nil {
+		t.Fatal(err)
+	}
+	if run := r.waitRun(t, 2); run.Result == plateGenie.RunComplete || run.Strokes != 0 {
+		t.Errorf("Run with a 500 mm stroke recorded as %+v", run)
+	}
+}
+
+func TestMoveTiming(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s := r.pg.Settings()
+	s.SpeedPercentage = 20
+	if err := r.pg.SetSettings(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every move of the same length takes the same time, however late the steps were released
+	var first time.Duration
+	for k := 0; k < 3; k++ {
+		start := time.Now()
+		if err := r.pg.MoveBy(ctx, 500); err != nil {
+			t.Fatal(err)
+		}
+		d := time.Since(start)
+		tm := r.pg.LastMoveTiming()
+		if tm.Steps != 500 || tm.Planned == 0 || tm.Actual < tm.Planned {
+			t.Errorf("Move %d timed as %+v", k, tm)
+		}
+		if k == 0 {
+			first = d
+		} else if diff := d - first; diff > 50*time.Millisecond || diff < -50*time.Millisecond {
+			t.Errorf("Move %d took %v, the first took %v", k, d, first)
+		}
+		if err := r.pg.MoveBy(ctx, -500); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+	r := newRig(t, rail)
+	ctx := context.Background()
+	if err := r.pg.Home(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of them gets the machine, and the other is turned away rather than interleaving its steps
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = r.pg.MoveTo(ctx, 0)
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = r.pg.StartAgitation(ctx)
+	}()
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, plateGenie.ErrBusy) {
+			t.Errorf("Got %v, want nil or ErrBusy", err)
+		}
+	}
+	if errs[0] != nil && errs[1] != nil {
+		t.Error("Both commands were refused")
+	}
+	r.pg.StopAgitation(ctx)
+	r.waitCycleEnd(t)
+	if lost := r.m.LostSteps(); lost != 0 {
+		t.Errorf("Lost %d steps", lost)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"fmt"
+	"sync"
+)
+
+type MachineState int
+
+const (
+	// Stopped, but the carriage position is not known
+	StateUnhomed MachineState = iota
+	// Homed and stopped
+	StateIdle
+	// A homing operation is in progress
+	StateHoming
+	// A single move is in progress
+	StateMoving
+	// An agitation cycle is in progress
+	StateAgitating
+	// Motion is inhibited until the emergency stop is reset with the green button
+	StateEStopped
+	// Something went wrong, e.g. a limit switch was hit during a move. Reset with the green button and home again.
+	StateFaulted
+)
+
+func (s MachineState) String() string {
+	switch s {
+	case StateUnhomed:
+		return "Unhomed"
+	case StateIdle:
+		return "Idle"
+	case StateHoming:
+		return "Homing"
+	case StateMoving:
+		return "Moving"
+	case StateAgitating:
+		return "Agitating"
+	case StateEStopped:
+		return "EStopped"
+	case StateFaulted:
+		return "Faulted"
+	}
+	return fmt.Sprintf("MachineState(%d)", int(s))
+}
+
+// Permitted transitions. An emergency stop is permitted from every state except Faulted, which already inhibits
+// motion.
+var stateTransitions = map[MachineState][]MachineState{
+	StateUnhomed:   {StateHoming, StateEStopped, StateFaulted},
+	StateIdle:      {StateHoming, StateMoving, StateAgitating, StateEStopped, StateFaulted},
+	StateHoming:    {StateIdle, StateUnhomed, StateEStopped, StateFaulted},
+	StateMoving:    {StateIdle, StateEStopped, StateFaulted},
+	StateAgitating: {StateIdle, StateEStopped, StateFaulted},
+	StateEStopped:  {StateIdle, StateUnhomed},
+	StateFaulted:   {StateUnhomed},
+}
+
+// Machine state with checked transitions. Safe for use from multiple goroutines.
+type stateMachine struct {
+	mu sync.Mutex
+
+	state MachineState
+	// Reason given for the last transition
+	reason string
+	// Whether the step count between the switches and the position are known. Survives an emergency stop so that
+	// the machine can go back to Idle afterwards.
+	homed bool
+}
+
+func newStateMachine(state MachineState, reason string) *stateMachine {
+	return &stateMachine{state: state, reason: reason}
+}
+
+func (sm *stateMachine) get() (MachineState, string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.state, sm.reason
+}
+
+// Move to a new state if the transition is permitted
+func (sm *stateMachine) transition(to MachineState, reason string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.transitionLocked(to, reason)
+}
+
+// Move to a new state only if the machine is still in the expected state. Used to end a motion state without
+// overriding an emergency stop or a fault that happened in the meantime. Returns false if the state had changed.
+func (sm *stateMachine) transitionFrom(from MachineState, to MachineState, reason string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.state != from {
+		return false
+	}
+	return sm.transitionLocked(to, reason) == nil
+}
+
+func (sm *stateMachine) transitionLocked(to MachineState, reason string) error {
+	permitted := false
+	for _, s := range stateTransitions[sm.state] {
+		if s == to {
+			permitted = true
+			break
+		}
+	}
+	if !permitted {
+		return &StateError{Op: reason, State: sm.state, Reason: sm.reason}
+	}
+
+	fmt.Printf("State %v -> %v: %s\n", sm.state, to, reason)
+
+	switch to {
+	case StateIdle:
+		sm.homed = true
+	case StateUnhomed, StateFaulted, StateHoming:
+		// Homing steps are not counted in the position, so homing that is interrupted leaves the machine unhomed
+		sm.homed = false
+	}
+	sm.state = to
+	sm.reason = reason
+
+	return nil
+}
+
+// Inhibit motion. Does nothing if the machine is already stopped by an emergency stop or a fault.
+func (sm *stateMachine) eStop(reason string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.state == StateEStopped || sm.state == StateFaulted {
+		return
+	}
+	sm.transitionLocked(StateEStopped, reason)
+}
+
+// Clear an emergency stop or a fault. After an emergency stop the machine goes back to Idle if it was homed. After a
+// fault it always has to be homed again.
+func (sm *stateMachine) reset(reason string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	switch sm.state {
+	case StateEStopped:
+		if sm.homed {
+			return sm.transitionLocked(StateIdle, reason)
+		}
+		return sm.transitionLocked(StateUnhomed, reason)
+	case StateFaulted:
+		return sm.transitionLocked(StateUnhomed, reason)
+	}
+	return &StateError{Op: reason, State: sm.state, Reason: sm.reason}
+}
+
+// Fault the machine if one of the given motion states is active. Returns false otherwise.
+func (sm *stateMachine) faultIf(reason string, states ...MachineState) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, s := range states {
+		if sm.state == s {
+			return sm.transitionLocked(StateFaulted, reason) == nil
+		}
+	}
+	return false
+}
+
+// Checked by the motion loops before every step. Returns an error if the motion has to stop.
+func (sm *stateMachine) checkMotion() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	switch sm.state {
+	case StateHoming, StateMoving, StateAgitating:
+		return nil
+	}
+	return &StateError{Op: "Motion", State: sm.state, Reason: sm.reason}
+}
+
+// Current state of the machine and the reason given for the last transition
+func (pg *PlateGenie) State() (MachineState, string) {
+	return pg.state.get()
+}
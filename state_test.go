@@ -0,0 +1,82 @@
+package plateGenie
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStateTransitions(t *testing.T) {
+	tests := []struct {
+		from MachineState
+		to   MachineState
+		ok   bool
+	}{
+		{StateUnhomed, StateHoming, true},
+		{StateUnhomed, StateMoving, false},
+		{StateUnhomed, StateAgitating, false},
+		{StateIdle, StateMoving, true},
+		{StateIdle, StateAgitating, true},
+		{StateMoving, StateAgitating, false},
+		{StateHoming, StateMoving, false},
+		{StateAgitating, StateIdle, true},
+		{StateEStopped, StateMoving, false},
+		{StateFaulted, StateIdle, false},
+		{StateFaulted, StateEStopped, false},
+	}
+	for _, test := range tests {
+		sm := newStateMachine(test.from, "Test")
+		err := sm.transition(test.to, "Test")
+		if (err == nil) != test.ok {
+			t.Errorf("%v -> %v: got %v", test.from, test.to, err)
+		}
+		if s, _ := sm.get(); err != nil && s != test.from {
+			t.Errorf("%v -> %v: refused but the state changed to %v", test.from, test.to, s)
+		}
+	}
+}
+
+func TestStateErrors(t *testing.T) {
+	tests := []struct {
+		state MachineState
+		want  error
+	}{
+		{StateUnhomed, ErrNotHomed},
+		{StateMoving, ErrBusy},
+		{StateEStopped, ErrEStopped},
+		{StateFaulted, ErrFaulted},
+	}
+	for _, test := range tests {
+		sm := newStateMachine(test.state, "Test")
+		if err := sm.transition(StateAgitating, "Agitate"); !errors.Is(err, test.want) {
+			t.Errorf("Agitate in %v: got %v, want %v", test.state, err, test.want)
+		}
+	}
+}
+
+func TestStateReset(t *testing.T) {
+	tests := []struct {
+		name string
+		path []MachineState
+		want MachineState
+	}{
+		{"Homed", []MachineState{StateHoming, StateIdle, StateMoving}, StateIdle},
+		{"Never homed", []MachineState{StateHoming}, StateUnhomed},
+		{"Homing again", []MachineState{StateHoming, StateIdle, StateHoming}, StateUnhomed},
+		{"Faulted while homed", []MachineState{StateHoming, StateIdle, StateMoving, StateFaulted}, StateUnhomed},
+	}
+	for _, test := range tests {
+		sm := newStateMachine(StateUnhomed, "Test")
+		for _, s := range test.path {
+			if err := sm.transition(s, "Test"); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		sm.eStop("Test")
+		if err := sm.reset("Test"); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if s, _ := sm.get(); s != test.want {
+			t.Errorf("%s: reset to %v, want %v", test.name, s, test.want)
+		}
+	}
+}
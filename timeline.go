@@ -0,0 +1,277 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// A planned move: the direction and the time of every step, worked out before the motor turns. Planning is only
+// maths, so a timeline can be checked, tested or graphed on its own. See executor.go for playing one on the stepper.
+type Timeline struct {
+	Forward bool
+	// Time of each step from the start of the move
+	Steps []time.Duration
+	// Length of the move. The last step is followed by its pulse and any slow-down.
+	Duration time.Duration
+	// Number of steps at the start that speed the move up. A feed hold comes to rest by running them backwards.
+	Ramp int
+	// First step of the slow-down at the end of the move. A feed hold from here on lets the move finish.
+	Decel int
+	// Deceleration in steps per second squared for a feed hold in a move that speeds up and slows down on the way,
+	// such as a blended run. It comes to rest from the speed it is at instead of running the ramp backwards. 0 for
+	// moves that only speed up once.
+	Braking float64
+}
+
+// Build a timeline from the sleep after each step, the way the motion loops used to pace themselves
+func timelineFromSleeps(forward bool, sleeps []time.Duration, pulseDuration time.Duration) Timeline {
+	t := Timeline{Forward: forward, Steps: make([]time.Duration, len(sleeps))}
+	var at time.Duration
+	for k, sleep := range sleeps {
+		t.Steps[k] = at
+		at += pulseDuration + sleep
+	}
+	t.Duration = at
+	return t
+}
+
+// Time from step k to the next one, or to the end of the move for the last step
+func (t Timeline) interval(k int) time.Duration {
+	if k < len(t.Steps)-1 {
+		return t.Steps[k+1] - t.Steps[k]
+	}
+	return t.Duration - t.Steps[k]
+}
+
+// Steps that bring the move to rest from step k, with their times from when step k is due. Close to the end of the
+// move the rest of it is the quickest way to rest, and that is what is returned.
+func (t Timeline) stopFrom(k int) Timeline {
+	remaining := len(t.Steps) - k
+	stop := Timeline{Forward: t.Forward}
+
+	if t.Braking == 0 {
+		ramp := k
+		if ramp > t.Ramp {
+			ramp = t.Ramp
+		}
+		var at time.Duration
+		for j := ramp - 1; j >= 0 && len(stop.Steps) < remaining; j-- {
+			stop.Steps = append(stop.Steps, at)
+			at += t.interval(j)
+		}
+		stop.Duration = at
+		return stop
+	}
+
+	if k == 0 {
+		return stop
+	}
+	// Speed over the last step, slowed down at a constant rate
+	v := 1 / t.interval(k-1).Seconds()
+	a := t.Braking
+	seconds := func(s float64) time.Duration {
+		return time.Duration(s * float64(time.Second))
+	}
+	if n := int(v * v / (2 * a)); n <= remaining {
+		for j := 0; j < n; j++ {
+			stop.Steps = append(stop.Steps, seconds((v-math.Sqrt(v*v-2*a*float64(j)))/a))
+		}
+		stop.Duration = seconds(v / a)
+		return stop
+	}
+
+	for _, at := range t.Steps[k:] {
+		stop.Steps = append(stop.Steps, at-t.Steps[k])
+	}
+	stop.Duration = t.Duration - t.Steps[k]
+	return stop
+}
+
+// Check the timeline against the stepper: every step needs at least the pulse duration before the next one
+func (t Timeline) Check(pulseDuration time.Duration) error {
+	if t.Ramp < 0 || t.Ramp > len(t.Steps) {
+		return &RangeError{"Ramp steps", t.Ramp, 0, len(t.Steps)}
+	}
+	if t.Decel < 0 || t.Decel > len(t.Steps) {
+		return &RangeError{"Deceleration step", t.Decel, 0, len(t.Steps)}
+	}
+	for k := range t.Steps {
+		if t.interval(k) < pulseDuration {
+			return fmt.Errorf("Step %d of %d is only %v long, less than the %v stepper pulse", k, len(t.Steps),
+				t.interval(k), pulseDuration)
+		}
+	}
+	return nil
+}
+
+// Time per step at a percentage of the maximum stepper speed, to the nanosecond. Percentages are not rounded, so any
+// speed in mm/s or in percent is planned within speedTolerance.
+func stepPeriod(pulseDuration time.Duration, speedPercentage float64) time.Duration {
+	return time.Duration(math.Round(float64(pulseDuration) * 100 / speedPercentage))
+}
+
+// Split a signed number of steps into a direction and a count
+func direction(numStepsSigned int) (bool, int) {
+	if numStepsSigned < 0 {
+		return false, -numStepsSigned
+	}
+	return true, numStepsSigned
+}
+
+// Plan a move with the profile, speed and acceleration in the settings, in mm or in percentages
+func (pg *PlateGenie) planMove(numStepsSigned int, s Settings) (Timeline, error) {
+	pulseDuration := pg.stepper.GetPulseDuration()
+
+	speedPercentage, err := pg.speedPercentage(s)
+	if err != nil {
+		return Timeline{}, err
+	}
+
+	if s.Profile == ProfileSCurve {
+		if speedPercentage < 1 || speedPercentage > 100 {
+			return Timeline{}, &RangeError{"Speed percentage", int(speedPercentage), 1, 100}
+		}
+		acceleration, err := pg.sCurveAcceleration(s)
+		if err != nil {
+			return Timeline{}, err
+		}
+		velocity := pg.maxStepsPerSecond() * speedPercentage / 100
+		return sCurveTimeline(numStepsSigned, velocity, acceleration, float64(pg.config.SCurve.Jerk), pulseDuration),
+			nil
+	}
+	if s.Profile == ProfileSinusoidal {
+		return sinusoidalTimeline(numStepsSigned, speedPercentage, pulseDuration)
+	}
+
+	_, numSteps := direction(numStepsSigned)
+	constantSpeedPercentage, err := pg.constantSpeedPercentage(s, numSteps, speedPercentage)
+	if err != nil {
+		return Timeline{}, err
+	}
+	return trapezoidalTimeline(numStepsSigned, speedPercentage, constantSpeedPercentage, pulseDuration)
+}
+
+// Trapezoidal acceleration profile
+// numSteps: total number of steps to move
+// speedPercentage: percentage of max stepper speed to move
+// constantSpeedPercentage: percentage of time spent at constant speed
+func trapezoidalTimeline(numStepsSigned int, speedPercentage float64, constantSpeedPercentage int,
+	pulseDuration time.Duration) (Timeline, error) {
+	if speedPercentage < 1 || speedPercentage > 100 {
+		return Timeline{}, &RangeError{"Speed percentage", int(speedPercentage), 1, 100}
+	} else if constantSpeedPercentage < 1 || constantSpeedPercentage > 99 {
+		return Timeline{}, &RangeError{"Constant speed percentage", constantSpeedPercentage, 1, 99}
+	}
+
+	forward, numSteps := direction(numStepsSigned)
+	if numSteps == 0 {
+		// Do nothing as no motion was requested
+		return Timeline{Forward: forward}, nil
+	}
+
+	// Amount of total time taken per step at constant speed: stepper time AND speedPercentage slow-down time
+	// are both included
+	constantSpeedDelay := stepPeriod(pulseDuration, speedPercentage)
+	// Delay added to slow down the stepper by the speedPeercentage parameter
+	constantSpeedDelta := constantSpeedDelay - pulseDuration
+
+	// I derived this equation on paper. The assumption that I made is that the average velocity of the trapezoidal
+	// ramps is half the constant velocity.
+
+	numStepsAccelDecel := int(float32(numSteps) / (2/(100/float32(constantSpeedPercentage)-1) + 1))
+	numStepsAccel := numStepsAccelDecel / 2
+	numStepsDecel := numStepsAccelDecel - numStepsAccel
+	numStepsConstantSpeed := numSteps - numStepsAccel - numStepsDecel
+
+	// Actual acceleration time
+	accelTime := time.Duration(numStepsAccel) * 2 * constantSpeedDelay
+	// Mininum acceleration time based on the stepper speed
+	minAccelTime := time.Duration(numStepsAccel) * pulseDuration
+	// Amount of sleep time difference between two acceleration steps (accumulate). Short moves have no ramp.
+	var accelDelta time.Duration
+	if numStepsAccel > 0 {
+		accelDelta = (accelTime - minAccelTime) / time.Duration(numStepsAccel*numStepsAccel)
+	}
+
+	sleeps := make([]time.Duration, 0, numSteps)
+	// Start at the slowest part of the ramp
+	for k := 0; k < numStepsAccel; k++ {
+		sleeps = append(sleeps, constantSpeedDelta+accelDelta*time.Duration(numStepsAccel-k))
+	}
+	for k := 0; k < numStepsConstantSpeed; k++ {
+		sleeps = append(sleeps, constantSpeedDelta)
+	}
+	// The deceleration mirrors the acceleration
+	for k := 0; k < numStepsDecel; k++ {
+		sleeps = append(sleeps, constantSpeedDelta+accelDelta*time.Duration(k))
+	}
+
+	t := timelineFromSleeps(forward, sleeps, pulseDuration)
+	t.Ramp = numStepsAccel
+	t.Decel = numStepsAccel + numStepsConstantSpeed
+	return t, nil
+}
+
+// Sinusoidal profile. The position follows half a cosine wave from the start to the end of the move, and the speed
+// peaks at speedPercentage of the maximum stepper speed half way along. A feed hold in the first half slows down along
+// the same curve.
+func sinusoidalTimeline(numStepsSigned int, speedPercentage float64, pulseDuration time.Duration) (Timeline,
+	error) {
+	if speedPercentage < 1 || speedPercentage > 100 {
+		return Timeline{}, &RangeError{"Speed percentage", int(speedPercentage), 1, 100}
+	}
+
+	forward, numSteps := direction(numStepsSigned)
+	if numSteps == 0 {
+		return Timeline{Forward: forward}, nil
+	}
+
+	// Time per step at the peak speed, the same as the constant speed of a trapezoidal move
+	peakStepTime := stepPeriod(pulseDuration, speedPercentage)
+
+	t := timelineFromSleeps(forward, sinusoidalSleepTimes(numSteps, peakStepTime, pulseDuration), pulseDuration)
+	t.Ramp = numSteps / 2
+	t.Decel = numSteps / 2
+	return t, nil
+}
+
+// Jerk-limited S-curve profile within the velocity, acceleration and jerk limits in steps per second. A feed hold
+// while speeding up or cruising runs the speed-up backwards, which is the same curve as the slow-down at the end.
+func sCurveTimeline(numStepsSigned int, velocity float64, acceleration float64, jerk float64,
+	pulseDuration time.Duration) Timeline {
+
+	forward, numSteps := direction(numStepsSigned)
+	if numSteps == 0 {
+		return Timeline{Forward: forward}
+	}
+
+	c := planSCurve(float64(numSteps), velocity, acceleration, jerk)
+	t := timelineFromSleeps(forward, c.sleepTimes(numSteps, pulseDuration), pulseDuration)
+	t.Ramp = int(c.rampSteps())
+	t.Decel = numSteps - t.Ramp
+	return t
+}
@@ -0,0 +1,209 @@
+package plateGenie
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+const testPulse = 50 * time.Microsecond
+
+func TestTrapezoidalTimeline(t *testing.T) {
+	tests := []struct {
+		steps         int
+		speed         float64
+		constantSpeed int
+		forward       bool
+		ramp, decel   int
+		duration      time.Duration
+	}{
+		// 125 steps up, 750 at 100us per step and 125 down, with 1.2us more sleep for each step of the ramps
+		{1000, 50, 60, true, 125, 875, 118750 * time.Microsecond},
+		{-1000, 50, 50, false, 166, 833, 125032966 * time.Nanosecond},
+		{400, 100, 80, true, 22, 378, 21099648 * time.Nanosecond},
+		// Too short for a ramp
+		{3, 50, 50, true, 0, 2, 300 * time.Microsecond},
+		{1, 25, 50, true, 0, 1, 200 * time.Microsecond},
+		{0, 50, 50, true, 0, 0, 0},
+	}
+	for _, test := range tests {
+		tl, err := trapezoidalTimeline(test.steps, test.speed, test.constantSpeed, testPulse)
+		if err != nil {
+			t.Errorf("%d steps: %v", test.steps, err)
+			continue
+		}
+		_, numSteps := direction(test.steps)
+		if len(tl.Steps) != numSteps || tl.Forward != test.forward {
+			t.Errorf("%d steps: planned %d steps, forward %v", test.steps, len(tl.Steps), tl.Forward)
+		}
+		if tl.Ramp != test.ramp || tl.Decel != test.decel {
+			t.Errorf("%d steps: ramp %d and deceleration from %d, want %d and %d", test.steps, tl.Ramp, tl.Decel,
+				test.ramp, test.decel)
+		}
+		if tl.Duration != test.duration {
+			t.Errorf("%d steps: duration %v, want %v", test.steps, tl.Duration, test.duration)
+		}
+		if err := tl.Check(testPulse); err != nil {
+			t.Errorf("%d steps: %v", test.steps, err)
+		}
+	}
+}
+
+func TestTrapezoidalTimelineRange(t *testing.T) {
+	tests := []struct {
+		speed         float64
+		constantSpeed int
+	}{
+		{0, 50},
+		{101, 50},
+		{50, 0},
+		{50, 100},
+	}
+	for _, test := range tests {
+		if _, err := trapezoidalTimeline(100, test.speed, test.constantSpeed, testPulse); !errors.Is(err,
+			ErrOutOfRange) {
+			t.Errorf("Speed %v and constant speed %d: got %v, want ErrOutOfRange", test.speed, test.constantSpeed,
+				err)
+		}
+	}
+}
+
+func TestTimelineCheck(t *testing.T) {
+	steps := []time.Duration{0, 100 * time.Microsecond, 200 * time.Microsecond}
+	tests := []struct {
+		name string
+		tl   Timeline
+		ok   bool
+	}{
+		{"Even steps", Timeline{Steps: steps, Duration: 300 * time.Microsecond, Ramp: 1, Decel: 2}, true},
+		{"Empty", Timeline{}, true},
+		{"Short step", Timeline{Steps: []time.Duration{0, 20 * time.Microsecond}, Duration: time.Millisecond}, false},
+		{"Short last step", Timeline{Steps: steps, Duration: 210 * time.Microsecond}, false},
+		{"Ramp too long", Timeline{Steps: steps, Duration: 300 * time.Microsecond, Ramp: 4}, false},
+		{"Negative deceleration", Timeline{Steps: steps, Duration: 300 * time.Microsecond, Decel: -1}, false},
+	}
+	for _, test := range tests {
+		if err := test.tl.Check(testPulse); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestSCurveTimeline(t *testing.T) {
+	tests := []struct {
+		steps       int
+		ramp, decel int
+	}{
+		// 0.1s of jerk up and down and 0.15s at full acceleration reach 500 steps per second in 87.5 steps
+		{4000, 87, 3913},
+		{-4000, 87, 3913},
+		// Too short to reach the speed
+		{100, 50, 50},
+		{1, 0, 1},
+	}
+	for _, test := range tests {
+		tl := sCurveTimeline(test.steps, 500, 2000, 20000, testPulse)
+		_, numSteps := direction(test.steps)
+		if len(tl.Steps) != numSteps || tl.Forward != (test.steps > 0) {
+			t.Errorf("%d steps: planned %d steps, forward %v", test.steps, len(tl.Steps), tl.Forward)
+		}
+		if tl.Ramp != test.ramp || tl.Decel != test.decel {
+			t.Errorf("%d steps: ramp %d and deceleration from %d, want %d and %d", test.steps, tl.Ramp, tl.Decel,
+				test.ramp, test.decel)
+		}
+		if err := tl.Check(testPulse); err != nil {
+			t.Errorf("%d steps: %v", test.steps, err)
+		}
+	}
+
+	// A feed hold runs the ramp backwards from its top, so the cruise has to go no faster than the top of the ramp
+	tl := sCurveTimeline(4000, 500, 2000, 20000, testPulse)
+	top := tl.interval(tl.Ramp - 1)
+	for k := tl.Ramp; k < tl.Decel; k++ {
+		if tl.interval(k) < top*99/100 {
+			t.Fatalf("Step %d takes %v, faster than the %v at the top of the ramp", k, tl.interval(k), top)
+		}
+	}
+}
+
+func TestSinusoidalTimeline(t *testing.T) {
+	for _, steps := range []int{401, -400, 1} {
+		tl, err := sinusoidalTimeline(steps, 50, testPulse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, numSteps := direction(steps)
+		if len(tl.Steps) != numSteps || tl.Ramp != numSteps/2 || tl.Decel != numSteps/2 {
+			t.Errorf("%d steps: planned %d steps, ramp %d and deceleration from %d", steps, len(tl.Steps), tl.Ramp,
+				tl.Decel)
+		}
+		if err := tl.Check(testPulse); err != nil {
+			t.Errorf("%d steps: %v", steps, err)
+		}
+	}
+	if _, err := sinusoidalTimeline(100, 0, testPulse); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("Speed 0: got %v, want ErrOutOfRange", err)
+	}
+}
+
+// Quickest step of a timeline, which is the peak speed of the move
+func peakInterval(tl Timeline) time.Duration {
+	peak := tl.interval(0)
+	for k := range tl.Steps {
+		if tl.interval(k) < peak {
+			peak = tl.interval(k)
+		}
+	}
+	return peak
+}
+
+func TestSpeedAccuracy(t *testing.T) {
+	// Every whole percentage is its own speed, and hits the step rate to within the tolerance in every profile
+	pg := newTestPlateGenie(0)
+	// Stiff enough for the S-curve to reach full speed well within the move
+	pg.config.SCurve.MaxAcceleration, pg.config.SCurve.Jerk = 100000, 1000000
+	seen := map[time.Duration]int{}
+	for pct := 1; pct <= 100; pct++ {
+		s := defaultSettings()
+		s.SpeedPercentage = pct
+		want := float64(testPulse) * 100 / float64(pct)
+		for _, p := range profiles {
+			s.Profile = p
+			tl, err := pg.planMove(20000, s)
+			if err != nil {
+				t.Fatalf("%d%% %s: %v", pct, p, err)
+			}
+			peak := peakInterval(tl)
+			if math.Abs(float64(peak)-want)/want > speedTolerance {
+				t.Errorf("%d%% %s: quickest step takes %v, want %v", pct, p, peak, time.Duration(want))
+			}
+			if p == ProfileTrapezoidal {
+				if other, ok := seen[peak]; ok {
+					t.Errorf("%d%% and %d%% run at the same speed", other, pct)
+				}
+				seen[peak] = pct
+			}
+		}
+	}
+
+	// Speeds in mm/s are not rounded to a whole percentage
+	pg = newTestPlateGenie(100)
+	pg.config.SCurve.Jerk = 1000000
+	for _, speed := range []float64{2.5, 17.3, 123.4, 199.9} {
+		s := defaultSettings()
+		s.SpeedMmPerSecond = speed
+		s.AccelerationMmPerSecond2 = 1000
+		want := float64(time.Second) / (speed * 100)
+		for _, p := range profiles {
+			s.Profile = p
+			tl, err := pg.planMove(20000, s)
+			if err != nil {
+				t.Fatalf("%g mm/s %s: %v", speed, p, err)
+			}
+			if peak := peakInterval(tl); math.Abs(float64(peak)-want)/want > speedTolerance {
+				t.Errorf("%g mm/s %s: quickest step takes %v, want %v", speed, p, peak, time.Duration(want))
+			}
+		}
+	}
+}
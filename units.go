@@ -0,0 +1,218 @@
+/*
+Copyright (c) 2018 Forrest Sibley <My^Name^Without^The^Surname@ieee.org>
+
+Permission is hereby granted, free of charge, to any person obtaining
+a copy of this software and associated documentation files (the
+"Software"), to deal in the Software without restriction, including
+without limitation the rights to use, copy, modify, merge, publish,
+distribute, sublicense, and/or sell copies of the Software, and to
+permit persons to whom the Software is furnished to do so, subject to
+the following conditions:
+
+The above copyright notice and this permission notice shall be
+included in all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND,
+EXPRESS OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND
+NONINFRINGEMENT. IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE
+LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION
+OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION
+WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+*/
+
+package plateGenie
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Motion can be given in millimetres as well as in percentages. The millimetre settings take precedence over the
+// percentages wherever they are set, and need stepper.stepsPerMm in the configuration. Millimetres mean the same on
+// every rig, so recipes written in them can be shared between rigs with different rails and pulleys.
+
+// Check an optional setting in mm. 0 leaves it unset.
+func checkMm(name string, value float64) error {
+	if value < 0 || math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%w: %s %g must be 0 or more", ErrOutOfRange, name, value)
+	}
+	return nil
+}
+
+// Whether the configuration has a steps per mm calibration
+func (pg *PlateGenie) calibrated() bool {
+	return pg.config.Stepper.StepsPerMm > 0
+}
+
+// Nearest whole number of steps to a distance in mm
+func (pg *PlateGenie) mmToSteps(mm float64) (int, error) {
+	if !pg.calibrated() {
+		return 0, ErrNotCalibrated
+	}
+	return int(math.Round(mm * pg.config.Stepper.StepsPerMm)), nil
+}
+
+func (pg *PlateGenie) stepsToMm(steps int) float64 {
+	return float64(steps) / pg.config.Stepper.StepsPerMm
+}
+
+// Fastest speed of the stepper in steps per second
+func (pg *PlateGenie) maxStepsPerSecond() float64 {
+	return 1 / pg.stepper.GetPulseDuration().Seconds()
+}
+
+// Speed percentage of a move, from SpeedMmPerSecond if it is set. A speed in mm/s is not rounded to a whole percent.
+func (pg *PlateGenie) speedPercentage(s Settings) (float64, error) {
+	if s.SpeedMmPerSecond == 0 {
+		return float64(s.SpeedPercentage), nil
+	}
+	if !pg.calibrated() {
+		return 0, ErrNotCalibrated
+	}
+	maxSpeed := pg.maxStepsPerSecond() / pg.config.Stepper.StepsPerMm
+	percentage := 100 * s.SpeedMmPerSecond / maxSpeed
+	if percentage > 100*(1+speedTolerance) {
+		return 0, fmt.Errorf("%w: %g mm/s is faster than the stepper's %.1f mm/s", ErrOutOfRange,
+			s.SpeedMmPerSecond, maxSpeed)
+	}
+	if percentage < 1 {
+		return 0, fmt.Errorf("%w: %g mm/s is slower than the slowest speed of %.1f mm/s", ErrOutOfRange,
+			s.SpeedMmPerSecond, maxSpeed/100)
+	}
+	return math.Min(percentage, 100), nil
+}
+
+// Length of an agitation stroke in steps, from TravelMm if it is set
+func (pg *PlateGenie) strokeSteps(s Settings) (int, error) {
+	travel := pg.TravelSteps()
+	if s.TravelMm == 0 {
+		return s.TravelPercentage * travel / 100, nil
+	}
+	steps, err := pg.mmToSteps(s.TravelMm)
+	if err != nil {
+		return 0, err
+	}
+	if steps > travel {
+		return 0, fmt.Errorf("%w: %g mm of travel is longer than the %.1f mm rail", ErrOutOfRange, s.TravelMm,
+			pg.stepsToMm(travel))
+	}
+	return steps, nil
+}
+
+// Percentage of time at constant speed for a trapezoidal move of numSteps at the speed percentage, from
+// AccelerationMmPerSecond2 if it is set. The ramps of a trapezoidal move cover v²/a steps between them, which gives the
+// share of the move at constant speed. Moves too short to reach the speed get the shortest constant speed section.
+func (pg *PlateGenie) constantSpeedPercentage(s Settings, numSteps int, speedPercentage float64) (int, error) {
+	if s.AccelerationMmPerSecond2 == 0 {
+		return s.ConstantSpeedPercentage, nil
+	}
+	if !pg.calibrated() {
+		return 0, ErrNotCalibrated
+	}
+	velocity := pg.maxStepsPerSecond() * speedPercentage / 100
+	acceleration := s.AccelerationMmPerSecond2 * pg.config.Stepper.StepsPerMm
+	rampSteps := velocity * velocity / acceleration
+	n := float64(numSteps)
+	percentage := int(math.Round(100 * (n - rampSteps) / (n + rampSteps)))
+	if percentage < 1 {
+		percentage = 1
+	} else if percentage > 99 {
+		percentage = 99
+	}
+	return percentage, nil
+}
+
+// Acceleration of a trapezoidal move of numSteps at the velocity, in steps per second squared. From
+// AccelerationMmPerSecond2 if it is set, otherwise the ramps take up the share of the move left over by the constant
+// speed percentage.
+func (pg *PlateGenie) trapezoidalAcceleration(s Settings, numSteps int, velocity float64) (float64, error) {
+	if s.AccelerationMmPerSecond2 != 0 {
+		if !pg.calibrated() {
+			return 0, ErrNotCalibrated
+		}
+		return s.AccelerationMmPerSecond2 * pg.config.Stepper.StepsPerMm, nil
+	}
+	c := float64(s.ConstantSpeedPercentage) / 100
+	rampSteps := math.Max(float64(numSteps)*(1-c)/(1+c), 1)
+	return velocity * velocity / rampSteps, nil
+}
+
+// Acceleration limit of an S-curve move in steps per second squared, from AccelerationMmPerSecond2 if it is set and
+// from the configuration otherwise. The speed is a percentage of the maximum stepper speed, the same as for the other
+// profiles.
+func (pg *PlateGenie) sCurveAcceleration(s Settings) (float64, error) {
+	if s.AccelerationMmPerSecond2 == 0 {
+		return float64(pg.config.SCurve.MaxAcceleration), nil
+	}
+	if !pg.calibrated() {
+		return 0, ErrNotCalibrated
+	}
+	return s.AccelerationMmPerSecond2 * pg.config.Stepper.StepsPerMm, nil
+}
+
+// Speed of the settings in mm/s, converted from the percentage if SpeedMmPerSecond is not set
+func (pg *PlateGenie) speedMmPerSecond(s Settings) float64 {
+	if s.SpeedMmPerSecond != 0 || !pg.calibrated() {
+		return s.SpeedMmPerSecond
+	}
+	return pg.maxStepsPerSecond() * float64(s.SpeedPercentage) / 100 / pg.config.Stepper.StepsPerMm
+}
+
+// Stroke of the settings in mm, converted from the percentage if TravelMm is not set
+func (pg *PlateGenie) travelMm(s Settings) float64 {
+	if s.TravelMm != 0 || !pg.calibrated() {
+		return s.TravelMm
+	}
+	return pg.stepsToMm(s.TravelPercentage * pg.TravelSteps() / 100)
+}
+
+// Position in mm from the left end of the travel
+func (pg *PlateGenie) PositionMm() (float64, error) {
+	if !pg.calibrated() {
+		return 0, ErrNotCalibrated
+	}
+	return pg.stepsToMm(pg.Position()), nil
+}
+
+// Length of the travel in mm. Zero until the axis has been homed.
+func (pg *PlateGenie) TravelMm() (float64, error) {
+	if !pg.calibrated() {
+		return 0, ErrNotCalibrated
+	}
+	return pg.stepsToMm(pg.TravelSteps()), nil
+}
+
+// Move to an absolute position in mm, rounded to the nearest step
+func (pg *PlateGenie) MoveToMm(ctx context.Context, mm float64) error {
+	position, err := pg.mmToSteps(mm)
+	if err != nil {
+		return err
+	}
+	return pg.MoveTo(ctx, position)
+}
+
+// Move relative to the current position in mm, rounded to the nearest step. Positive distances move to the right.
+func (pg *PlateGenie) MoveByMm(ctx context.Context, mm float64) error {
+	steps, err := pg.mmToSteps(mm)
+	if err != nil {
+		return err
+	}
+	return pg.MoveBy(ctx, steps)
+}
+
+// Millimetres with at most one decimal place, for the menu
+func formatMm(mm float64) string {
+	return strconv.FormatFloat(math.Round(mm*10)/10, 'f', -1, 64)
+}
+
+// Step a value in mm on a menu item to the next multiple of the step in its direction. A value that is not on the
+// step, such as one converted from a percentage, lands on the nearest multiple.
+func stepMm(mm float64, step float64) float64 {
+	if step > 0 {
+		return (math.Floor(mm/step+1e-9) + 1) * step
+	}
+	return (math.Ceil(mm/-step-1e-9) - 1) * -step
+}
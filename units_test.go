@@ -0,0 +1,127 @@
+package plateGenie
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// Stepper that only reports its pulse, for planning moves without a machine
+type testStepper struct {
+	pulse time.Duration
+}
+
+func (s testStepper) StepForward()                    {}
+func (s testStepper) StepBackward()                   {}
+func (s testStepper) GetPulseDuration() time.Duration { return s.pulse }
+func (s testStepper) EnableHold()                     {}
+func (s testStepper) DisableHold()                    {}
+
+// Homed on a 2000 step travel at 20000 steps per second
+func newTestPlateGenie(stepsPerMm float64) *PlateGenie {
+	pg := &PlateGenie{config: DefaultConfig(), stepper: testStepper{testPulse}, homingStepCount: 2000}
+	pg.config.Stepper.StepsPerMm = stepsPerMm
+	return pg
+}
+
+func TestUnitsUncalibrated(t *testing.T) {
+	pg := newTestPlateGenie(0)
+	if _, err := pg.mmToSteps(1); !errors.Is(err, ErrNotCalibrated) {
+		t.Errorf("mmToSteps: got %v, want ErrNotCalibrated", err)
+	}
+	if _, err := pg.PositionMm(); !errors.Is(err, ErrNotCalibrated) {
+		t.Errorf("PositionMm: got %v, want ErrNotCalibrated", err)
+	}
+	s := defaultSettings()
+	s.SpeedMmPerSecond = 100
+	if _, err := pg.speedPercentage(s); !errors.Is(err, ErrNotCalibrated) {
+		t.Errorf("speedPercentage: got %v, want ErrNotCalibrated", err)
+	}
+
+	// The percentages work without a calibration
+	s = defaultSettings()
+	if p, err := pg.speedPercentage(s); err != nil || p != float64(s.SpeedPercentage) {
+		t.Errorf("speedPercentage = %v, %v", p, err)
+	}
+	if steps, err := pg.strokeSteps(s); err != nil || steps != s.TravelPercentage*20 {
+		t.Errorf("strokeSteps = %d, %v", steps, err)
+	}
+}
+
+func TestUnitsCalibrated(t *testing.T) {
+	// 20000 steps per second is 200 mm/s, and the 2000 step travel is 20 mm
+	pg := newTestPlateGenie(100)
+
+	if steps, err := pg.mmToSteps(12.345); err != nil || steps != 1235 {
+		t.Errorf("mmToSteps(12.345) = %d, %v", steps, err)
+	}
+	if mm, err := pg.TravelMm(); err != nil || mm != 20 {
+		t.Errorf("TravelMm() = %v, %v", mm, err)
+	}
+
+	speeds := []struct {
+		mmPerSecond float64
+		percentage  float64
+		ok          bool
+	}{
+		{100, 50, true},
+		{33.3, 16.65, true},
+		{200, 100, true},
+		// Rounding in the calibration is let through
+		{200.1, 100, true},
+		{201, 0, false},
+		{1, 0, false},
+	}
+	for _, test := range speeds {
+		s := defaultSettings()
+		s.SpeedMmPerSecond = test.mmPerSecond
+		p, err := pg.speedPercentage(s)
+		if (err == nil) != test.ok || (test.ok && math.Abs(p-test.percentage) > 1e-9) {
+			t.Errorf("%g mm/s: got %v%%, %v", test.mmPerSecond, p, err)
+		}
+		if !test.ok && !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("%g mm/s: got %v, want ErrOutOfRange", test.mmPerSecond, err)
+		}
+	}
+
+	s := defaultSettings()
+	s.TravelMm = 7.5
+	if steps, err := pg.strokeSteps(s); err != nil || steps != 750 {
+		t.Errorf("strokeSteps for 7.5 mm = %d, %v", steps, err)
+	}
+	s.TravelMm = 20.1
+	if _, err := pg.strokeSteps(s); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("strokeSteps longer than the rail: got %v, want ErrOutOfRange", err)
+	}
+
+	// 10000 steps per second at 100000 steps per second squared ramps over 1000 steps, a third of a 3000 step move
+	s = defaultSettings()
+	s.AccelerationMmPerSecond2 = 1000
+	if p, err := pg.constantSpeedPercentage(s, 3000, 50); err != nil || p != 50 {
+		t.Errorf("constantSpeedPercentage = %d, %v", p, err)
+	}
+	if p, err := pg.constantSpeedPercentage(s, 10, 50); err != nil || p != 1 {
+		t.Errorf("constantSpeedPercentage of a short move = %d, %v", p, err)
+	}
+}
+
+func TestStepMm(t *testing.T) {
+	tests := []struct {
+		mm, step, want float64
+	}{
+		{10, 0.5, 10.5},
+		{10, -0.5, 9.5},
+		{10.2, 0.5, 10.5},
+		{10.2, -0.5, 10},
+		{0.3, 0.1, 0.4},
+	}
+	for _, test := range tests {
+		if got := stepMm(test.mm, test.step); math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("stepMm(%g, %g) = %g, want %g", test.mm, test.step, got, test.want)
+		}
+	}
+	if s := formatMm(12.349); s != "12.3" {
+		t.Errorf("formatMm(12.349) = %q", s)
+	}
+}